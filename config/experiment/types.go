@@ -10,16 +10,29 @@ import (
 
 type FullyConnectedJson = map[string]string
 
+// DroneLinkConfig is the link between every pair of drones. Type is
+// "fixed_delay", "rate" to also limit the link to Rate bits per second with
+// bursts of up to Burst bytes, or "mobile" to follow the drones' trajectories
+// in the simulator's mobility section. Fixed delay links lose packets as
+// Loss says, in the form a simulator topology takes.
 type DroneLinkConfig struct {
-	Type  string `json:"type"`
-	Delay int    `json:"delay"`
+	Type  string      `json:"type"`
+	Delay int         `json:"delay"`
+	Rate  float64     `json:"rate"`
+	Burst int         `json:"burst"`
+	Loss  interface{} `json:"loss"`
 }
 
 type SimulatorConfig struct {
-	Timeout    int                           `json:"timeout"`
-	DroneLinks DroneLinkConfig               `json:"droneLinks"`
-	BaseLinks  FullyConnectedJson            `json:"baseLinks"`
-	Global     simulatorConfig.GeneralConfig `json:"global"`
+	Timeout    int                `json:"timeout"`
+	DroneLinks DroneLinkConfig    `json:"droneLinks"`
+	BaseLinks  FullyConnectedJson `json:"baseLinks"`
+	// Downlink traces from the base to each drone. Leave empty to only
+	// simulate traffic towards the base.
+	ReverseBaseLinks FullyConnectedJson            `json:"reverseBaseLinks"`
+	Global           simulatorConfig.GeneralConfig `json:"global"`
+	// Where each drone flies, for mobile drone links
+	Mobility *simulatorConfig.MobilityConfig `json:"mobility"`
 }
 
 type QueryJson = map[string]interface{}
@@ -49,12 +62,32 @@ type ConfigEntry interface {
 }
 
 type DelayEntry struct {
-	EntryType   string `json:"type"`
-	DelayMillis int    `json:"delay"`
+	EntryType   string      `json:"type"`
+	DelayMillis int         `json:"delay"`
+	Loss        interface{} `json:"loss,omitempty"`
 }
 
-func NewDelayEntry(delayMillis int) DelayEntry {
-	return DelayEntry{EntryType: "delay", DelayMillis: delayMillis}
+func NewDelayEntry(delayMillis int, loss interface{}) DelayEntry {
+	return DelayEntry{EntryType: "delay", DelayMillis: delayMillis, Loss: loss}
+}
+
+type RateEntry struct {
+	EntryType   string  `json:"type"`
+	DelayMillis int     `json:"delay"`
+	Rate        float64 `json:"rate"`
+	Burst       int     `json:"burst"`
+}
+
+func NewRateEntry(delayMillis int, rate float64, burst int) RateEntry {
+	return RateEntry{EntryType: "rate", DelayMillis: delayMillis, Rate: rate, Burst: burst}
+}
+
+type MobileEntry struct {
+	EntryType string `json:"type"`
+}
+
+func NewMobileEntry() MobileEntry {
+	return MobileEntry{EntryType: "mobile"}
 }
 
 type TraceEntry struct {
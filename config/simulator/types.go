@@ -4,24 +4,104 @@ package config
 type TopologyJson = map[string](map[string]interface{})
 
 type GeneralConfig struct {
-	RealSrcAddress      string       `json:"realSrcAddress"`
-	SimulatedSrcAddress int          `json:"simulatedSrcAddress"`
-	SimulatedDstAddress int          `json:"simulatedDstAddress"`
-	MaxQueueLength      int          `json:"maxQueueLength"`
-	MaxHops             int          `json:"maxHops"`
-	DevName             string       `json:"devName"`
-	DevSrcAddr          string       `json:"devSrcAddr"`
-	DevDstAddr          string       `json:"devDstAddr"`
-	RoutingTableNum     string       `json:"routingTableNum"`
-	RoutingAlgorithm    RouterConfig `json:"routingAlgorithm"`
+	RealSrcAddress      string           `json:"realSrcAddress"`
+	SimulatedSrcAddress int              `json:"simulatedSrcAddress"`
+	SimulatedDstAddress int              `json:"simulatedDstAddress"`
+	MaxQueueLength      int              `json:"maxQueueLength"`
+	MaxHops             int              `json:"maxHops"`
+	DevName             string           `json:"devName"`
+	DevSrcAddr          string           `json:"devSrcAddr"`
+	DevDstAddr          string           `json:"devDstAddr"`
+	DevSrcAddr6         string           `json:"devSrcAddr6"`
+	DevDstAddr6         string           `json:"devDstAddr6"`
+	DevMTU              int              `json:"devMtu"` // Largest packet the TUN device carries, left at the kernel's default when unset
+	RoutingTableNum     string           `json:"routingTableNum"`
+	RoutingAlgorithm    RouterConfig     `json:"routingAlgorithm"`
+	Seed                int64            `json:"seed"`
+	DuplicateWindow     int              `json:"duplicateWindow"`
+	Classifier          []ClassifierRule `json:"classifier"`
+	DrainTime           int              `json:"drainTime"`      // Milliseconds packets left on the links get to finish once a run ends
+	MetricsAddress      string           `json:"metricsAddress"` // Serves /metrics here when set, e.g. "localhost:9100"
+	ControlAddress      string           `json:"controlAddress"` // Serves the control API here when set, e.g. "unix:/tmp/simulator.sock"
+	Source              Endpoint         `json:"source"`
+	Sink                Endpoint         `json:"sink"`
+}
+
+// Where packets enter or leave the simulator. Type is "tun" (the default),
+// "pcap" or "udp". File is the capture to read or write for "pcap". Address
+// is the address to listen on for a "udp" source and the address to send to
+// for a "udp" sink.
+type Endpoint struct {
+	Type    string `json:"type"`
+	File    string `json:"file"`
+	Address string `json:"address"`
+}
+
+// Sends packets from matching flows into the simulation from drone
+// SimulatedSrc instead of SimulatedSrcAddress. Fields that are left out match
+// any packet. Protocol is "udp", "tcp", "icmp" or "icmpv6".
+type ClassifierRule struct {
+	SrcAddress   string `json:"srcAddress"`
+	Protocol     string `json:"protocol"`
+	SrcPort      int    `json:"srcPort"`
+	DstPort      int    `json:"dstPort"`
+	DSCP         *int   `json:"dscp"`
+	SimulatedSrc int    `json:"simulatedSrc"`
 }
 
 type RouterConfig struct {
 	Type      string `json:"type"`
 	UpdateLag int    `json:"updateLag"`
+	// Never send a packet back to a node it has already been through
+	AvoidLoops bool `json:"avoidLoops"`
+}
+
+// Event changes the simulation Time seconds after it starts. Action is one of
+// "link_down" or "link_up" (Src and Dst), "node_down" or "node_up" (Node),
+// "replace_link" (Src, Dst and a Link in the same format as a topology
+// entry), "max_hops" (MaxHops) or "router" (Router).
+type Event struct {
+	Time    float64      `json:"time"`
+	Action  string       `json:"action"`
+	Src     string       `json:"src"`
+	Dst     string       `json:"dst"`
+	Node    string       `json:"node"`
+	Link    interface{}  `json:"link"`
+	MaxHops int          `json:"maxHops"`
+	Router  RouterConfig `json:"router"`
+}
+
+// MobilityConfig moves nodes along waypoint files so that "mobile" links
+// change with the distance between their ends.
+type MobilityConfig struct {
+	Trajectories   map[string]string `json:"trajectories"`   // Waypoint file for each node
+	Model          PropagationConfig `json:"model"`          // How distance affects a link
+	UpdateInterval int               `json:"updateInterval"` // Milliseconds between checks of which nodes are in range, 100 by default
+}
+
+// PropagationConfig sets up a path loss model. Type is "free_space" (the
+// default) or "log_distance". Powers are in dBm, losses in dB, distances in
+// meters, frequencies in Hz and rates in bits per second.
+type PropagationConfig struct {
+	Type              string  `json:"type"`
+	Frequency         float64 `json:"frequency"`
+	ReferenceDistance float64 `json:"referenceDistance"`
+	ReferenceLoss     float64 `json:"referenceLoss"`
+	Exponent          float64 `json:"exponent"`
+	TxPower           float64 `json:"txPower"`
+	NoiseFloor        float64 `json:"noiseFloor"`
+	Bandwidth         float64 `json:"bandwidth"`
+	MaxRate           float64 `json:"maxRate"`
+	Range             float64 `json:"range"`
 }
 
 type Config struct {
-	Topology TopologyJson  `json:"topology"`
-	General  GeneralConfig `json:"general"`
+	Topology TopologyJson `json:"topology"`
+	// Links carrying return traffic from the base back to the drones. Uses
+	// the same format as Topology, with "base" allowed as a source.
+	ReverseTopology TopologyJson  `json:"reverseTopology"`
+	General         GeneralConfig `json:"general"`
+	Events          []Event       `json:"events"`
+	// Needed by any "mobile" links in the topology
+	Mobility *MobilityConfig `json:"mobility"`
 }
@@ -17,6 +17,7 @@ func ParseQuery(queryJson config.QueryJson) Query {
 			outputs = append(outputs, output.(string))
 		}
 		segmentQuery.Output = outputs
+		segmentQuery.Format, _ = queryJson["format"].(string)
 		return segmentQuery
 	} else if queryJson["type"] == "range" {
 		return ParseSingleOutputQuery(queryJson)
@@ -43,6 +44,7 @@ func ParseSingleOutputQuery(queryJson config.QueryJson) SingleOutputQuery {
 		rangeQuery.Length = int(queryJson["length"].(float64))
 		rangeQuery.StartMilliOffset = int(queryJson["start"].(float64))
 		rangeQuery.Output = queryJson["output"].(string)
+		rangeQuery.Format, _ = queryJson["format"].(string)
 		return rangeQuery
 	} else if queryJson["type"] == "full_file" {
 		var fullFileQuery FullFileQuery
@@ -59,6 +61,7 @@ func ParseSingleOutputQuery(queryJson config.QueryJson) SingleOutputQuery {
 		}
 		stitchQuery.Inputs = queryInputs
 		stitchQuery.Output = queryJson["output"].(string)
+		stitchQuery.Format, _ = queryJson["format"].(string)
 		return stitchQuery
 	} else if queryJson["type"] == "spotty" {
 		var spottyQuery SpottyQuery
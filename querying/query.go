@@ -18,18 +18,31 @@ type SingleOutputQuery interface {
 	Query
 }
 
+// Queries with Format "delay" work on delay traces rather than delivery and
+// loss traces.
 type RangeQuery struct {
 	Input            SingleOutputQuery `json:"input"`
 	StartMilliOffset int               `json:"start"`
 	Length           int               `json:"length"`
 	Output           string            `json:"output"`
+	Format           string            `json:"format"`
 }
 
 func (rq RangeQuery) Execute() {
 	rq.Input.Execute()
+	if rq.Format == "delay" {
+		rq.executeDelayRange()
+		return
+	}
 	rq.ExecuteWithInputFile()
 }
 
+func (rq RangeQuery) executeDelayRange() {
+	RunDelayProcessing([]string{rq.Input.Outfile()}, []string{rq.Output}, func(traceReaders []*bufio.Scanner, traceWriters []*bufio.Writer) {
+		WriteDelayRange(traceWriters[0], ReadDelayRows(traceReaders[0]), float64(rq.StartMilliOffset), float64(rq.Length))
+	})
+}
+
 func (rq RangeQuery) ExecuteWithInputFile() {
 	RunProcessing([]string{rq.Input.Outfile()}, []string{rq.Output}, func(traceReaders []*bufio.Scanner, lossReaders []*csv.Reader, traceWriters []*bufio.Writer, lossWriters []*csv.Writer) {
 		lastWrittenOffset := 0
@@ -68,10 +81,15 @@ type SegmentQuery struct {
 	Input       SingleOutputQuery `json:"input"`
 	NumSegments int               `json:"segments"`
 	Output      []string          `json:"output"`
+	Format      string            `json:"format"`
 }
 
 func (sq SegmentQuery) Execute() {
 	sq.Input.Execute()
+	if sq.Format == "delay" {
+		sq.executeDelaySegments()
+		return
+	}
 
 	duration := 0
 	ForEachOffsetFile(fmt.Sprintf("%s.pps", sq.Input.Outfile()), func(offset int) {
@@ -111,6 +129,20 @@ func (sq SegmentQuery) Execute() {
 	})
 }
 
+// Splits a delay trace into equal lengths, each a range of its own.
+func (sq SegmentQuery) executeDelaySegments() {
+	RunDelayProcessing([]string{sq.Input.Outfile()}, sq.Output, func(traceReaders []*bufio.Scanner, traceWriters []*bufio.Writer) {
+		rows := ReadDelayRows(traceReaders[0])
+		if len(rows) == 0 {
+			return
+		}
+		durationPerSegment := rows[len(rows)-1].Offset / float64(sq.NumSegments)
+		for i, traceWriter := range traceWriters {
+			WriteDelayRange(traceWriter, rows, float64(i)*durationPerSegment, durationPerSegment)
+		}
+	})
+}
+
 func (sq SegmentQuery) Outfiles() []string {
 	return sq.Output
 }
@@ -119,9 +151,17 @@ type FullFileQuery struct {
 	Batchname string `json:"batch"`
 	Tracename string `json:"trace"`
 	Output    string `json:"output"`
+	Format    string `json:"format"`
 }
 
 func (fq FullFileQuery) Execute() {
+	if fq.Format == "delay" {
+		if out, err := exec.Command("dropbox_uploader.sh", "download", fmt.Sprintf("%s.delay", GetRemoteTracePath(fq.Batchname, fq.Tracename)), fmt.Sprintf("%s.delay", fq.Output)).CombinedOutput(); err != nil {
+			print(string(out))
+			panic(err)
+		}
+		return
+	}
 	if out, err := exec.Command("dropbox_uploader.sh", "download", fmt.Sprintf("%s.pps", GetRemoteTracePath(fq.Batchname, fq.Tracename)), fmt.Sprintf("%s.pps", fq.Output)).CombinedOutput(); err != nil {
 		print(string(out))
 		panic(err)
@@ -143,6 +183,7 @@ func (fq FullFileQuery) Outfiles() []string {
 type StitchQuery struct {
 	Inputs []Query `json:"inputs"`
 	Output string  `json:"output"`
+	Format string  `json:"format"`
 }
 
 func (sq StitchQuery) Execute() {
@@ -152,6 +193,23 @@ func (sq StitchQuery) Execute() {
 		allInputs = append(allInputs, input.Outfiles()...)
 	}
 
+	if sq.Format == "delay" {
+		RunDelayProcessing(allInputs, []string{sq.Output}, func(traceReaders []*bufio.Scanner, traceWriters []*bufio.Writer) {
+			lastOffset := 0.
+			processedTraceWriter := traceWriters[0]
+			for _, traceReader := range traceReaders {
+				curOffset := 0.
+				ForEachDelayScanner(traceReader, func(offset float64, delay string) {
+					newOffset := lastOffset + offset
+					curOffset = newOffset
+					processedTraceWriter.WriteString(fmt.Sprintf("%s %s\n", FormatDelayOffset(newOffset), delay))
+				})
+				lastOffset = curOffset
+			}
+		})
+		return
+	}
+
 	RunProcessing(allInputs, []string{sq.Output}, func(traceReaders []*bufio.Scanner, lossReaders []*csv.Reader, traceWriters []*bufio.Writer, lossWriters []*csv.Writer) {
 		lastOffset := 0
 		processedTraceWriter := traceWriters[0]
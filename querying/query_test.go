@@ -0,0 +1,57 @@
+package querying
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// An input that is already on disk
+type localFile string
+
+func (f localFile) Execute()           {}
+func (f localFile) Outfile() string    { return string(f) }
+func (f localFile) Outfiles() []string { return []string{string(f)} }
+
+func TestDelayQueries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "querying")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(name string, contents string) {
+		if err := ioutil.WriteFile(name+".delay", []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(name string, expected string) {
+		contents, err := ioutil.ReadFile(name + ".delay")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(contents) != expected {
+			t.Fatalf("expected %s.delay to be:\n%s\ngot:\n%s", name, expected, contents)
+		}
+	}
+
+	write("flight", "0 10\n100.5 20\n200 30\n300 40\n")
+	RangeQuery{Input: localFile("flight"), StartMilliOffset: 50, Length: 200, Output: "middle", Format: "delay"}.Execute()
+	check("middle", "0 10\n50.5 20\n150 30\n200 30\n")
+
+	write("other", "0 5\n20.25 6\n")
+	StitchQuery{Inputs: []Query{localFile("middle"), localFile("other")}, Output: "stitched", Format: "delay"}.Execute()
+	check("stitched", "0 10\n50.5 20\n150 30\n200 30\n200 5\n220.25 6\n")
+
+	SegmentQuery{Input: localFile("stitched"), NumSegments: 2, Output: []string{"first", "second"}, Format: "delay"}.Execute()
+	check("first", "0 10\n50.5 20\n110.125 20\n")
+	check("second", "0 20\n39.875 30\n89.875 30\n89.875 5\n110.125 5\n")
+}
@@ -5,8 +5,10 @@ import (
 	"encoding/csv"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"strconv"
+	"strings"
 )
 
 func CreateScratchSpace() string {
@@ -115,6 +117,66 @@ func RunProcessing(inputs []string, outputs []string, doProcessing func([]*bufio
 	RemoveScratchSpace()
 }
 
+// RunDelayProcessing is RunProcessing for delay traces, which are kept in
+// "<name>.delay" files with no loss trace alongside them.
+func RunDelayProcessing(inputs []string, outputs []string, doProcessing func([]*bufio.Scanner, []*bufio.Writer)) {
+	var rawTraceScanners []*bufio.Scanner
+	for _, input := range inputs {
+		rawTrace, err := os.Open(fmt.Sprintf("%s.delay", input))
+		if err != nil {
+			panic(err)
+		}
+		defer rawTrace.Close()
+		rawTraceScanners = append(rawTraceScanners, bufio.NewScanner(rawTrace))
+	}
+
+	scratchDir := CreateScratchSpace()
+	if err := os.Chdir(scratchDir); err != nil {
+		panic(err)
+	}
+
+	var traceWriters []*bufio.Writer
+	for _, output := range outputs {
+		processedTraceFile, err := os.Create(fmt.Sprintf("%s.delay", output))
+		if err != nil {
+			panic(err)
+		}
+		defer processedTraceFile.Close()
+
+		traceWriter := bufio.NewWriter(processedTraceFile)
+		defer traceWriter.Flush()
+		traceWriters = append(traceWriters, traceWriter)
+	}
+
+	doProcessing(rawTraceScanners, traceWriters)
+
+	if err := os.Chdir(".."); err != nil {
+		panic(err)
+	}
+
+	removedInputs := make(map[string]bool)
+	for _, input := range inputs {
+		if _, ok := removedInputs[input]; !ok {
+			if err := os.Remove(fmt.Sprintf("%s.delay", input)); err != nil {
+				panic(err)
+			}
+			removedInputs[input] = true
+		}
+	}
+
+	renamedOutputs := make(map[string]bool)
+	for _, output := range outputs {
+		if _, ok := renamedOutputs[output]; !ok {
+			if err := os.Rename(fmt.Sprintf("%s/%s.delay", scratchDir, output), fmt.Sprintf("%s.delay", output)); err != nil {
+				panic(err)
+			}
+			renamedOutputs[output] = true
+		}
+	}
+
+	RemoveScratchSpace()
+}
+
 func GetRemoteTracePath(batchName string, traceName string) string {
 	return fmt.Sprintf("Drone-Project/measurements/iperf_traces/%s/traces/%s", batchName, traceName)
 }
@@ -171,3 +233,71 @@ func CopyFile(dst string, src string) {
 	}
 	io.Copy(dstFile, srcFile)
 }
+
+// ForEachDelayScanner goes through a delay trace's "offset_ms delay_ms" rows,
+// passing the delay on as it was written. Offsets can be fractions of a
+// millisecond, as they can for the simulator.
+func ForEachDelayScanner(scanner *bufio.Scanner, operator func(offset float64, delay string)) {
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		} else if len(fields) != 2 {
+			panic(fmt.Sprintf("bad delay trace line %q", scanner.Text()))
+		}
+		offset, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			panic(err)
+		}
+
+		operator(offset, fields[1])
+	}
+}
+
+type DelayRow struct {
+	Offset float64
+	Delay  string
+}
+
+func ReadDelayRows(scanner *bufio.Scanner) []DelayRow {
+	var rows []DelayRow
+	ForEachDelayScanner(scanner, func(offset float64, delay string) {
+		rows = append(rows, DelayRow{Offset: offset, Delay: delay})
+	})
+	return rows
+}
+
+// WriteDelayRange writes the rows from start up to start+length, with their
+// offsets counted from start. The delay in effect at start carries over to
+// it, and a last row at length marks where the range loops, so it lasts its
+// whole length.
+func WriteDelayRange(writer *bufio.Writer, rows []DelayRow, start float64, length float64) {
+	inEffect := ""
+	wroteStart := false
+	for _, row := range rows {
+		if row.Offset >= start+length {
+			break
+		} else if row.Offset < start {
+			inEffect = row.Delay
+			continue
+		}
+		if !wroteStart && row.Offset > start && inEffect != "" {
+			writer.WriteString(fmt.Sprintf("0 %s\n", inEffect))
+		}
+		wroteStart = true
+		writer.WriteString(fmt.Sprintf("%s %s\n", FormatDelayOffset(row.Offset-start), row.Delay))
+		inEffect = row.Delay
+	}
+	if inEffect == "" {
+		return
+	} else if !wroteStart {
+		writer.WriteString(fmt.Sprintf("0 %s\n", inEffect))
+	}
+	writer.WriteString(fmt.Sprintf("%s %s\n", FormatDelayOffset(length), inEffect))
+}
+
+// FormatDelayOffset writes an offset in milliseconds without a fractional
+// part unless it has one, rounded to the microsecond.
+func FormatDelayOffset(offset float64) string {
+	return strconv.FormatFloat(math.Round(offset*1000)/1000, 'f', -1, 64)
+}
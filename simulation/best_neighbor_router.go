@@ -1,7 +1,6 @@
 package simulation
 
 import (
-	"sync"
 	"time"
 )
 
@@ -16,10 +15,11 @@ type BestNeighborSimulator struct {
 	neighbors       NeighborMap
 	realDest        int
 	updateLagMillis time.Duration
-	mutex           sync.Mutex
+	clock           Clock
+	stats           RouterStats
 }
 
-func NewBestNeighborSimulator(neighborMap NeighborMap, realDest Address, updateLagMillis time.Duration) *BestNeighborSimulator {
+func NewBestNeighborSimulator(clock Clock, neighborMap NeighborMap, realDest Address, updateLagMillis time.Duration) *BestNeighborSimulator {
 	selfState := make(map[Address]SelfState)
 	for src, neighbors := range neighborMap {
 		for _, dst := range neighbors {
@@ -32,12 +32,19 @@ func NewBestNeighborSimulator(neighborMap NeighborMap, realDest Address, updateL
 		}
 	}
 	return &BestNeighborSimulator{
-		selfState: selfState,
-		neighbors: neighborMap,
-		realDest:  realDest,
+		selfState:       selfState,
+		neighbors:       neighborMap,
+		realDest:        realDest,
+		updateLagMillis: updateLagMillis,
+		clock:           clock,
+		stats:           RouterStats{Picks: make(map[Address]map[Address]int)},
 	}
 }
 
+func (s *BestNeighborSimulator) Name() string {
+	return "best_neighbor"
+}
+
 func (s *BestNeighborSimulator) OnLinkDequeue(p Packet) {
 	// Do nothing
 	return
@@ -46,7 +53,7 @@ func (s *BestNeighborSimulator) OnLinkDequeue(p Packet) {
 func (s *BestNeighborSimulator) OnIncomingPacket(src Address, dst Address) {
 	if dst == s.realDest {
 		state := s.selfState[src]
-		state.latestArrival = time.Now()
+		state.latestArrival = s.clock.Now()
 		s.selfState[src] = state
 	}
 }
@@ -54,13 +61,10 @@ func (s *BestNeighborSimulator) OnIncomingPacket(src Address, dst Address) {
 func (s *BestNeighborSimulator) OnOutgoingPacket(p Packet) {
 	if p.GetDst() == s.realDest {
 		state := s.selfState[p.GetSrc()]
-		state.latestLatency = time.Since(state.latestArrival)
-		go func(Packet, SelfState) {
-			time.Sleep(s.updateLagMillis)
-			s.mutex.Lock()
+		state.latestLatency = s.clock.Now().Sub(state.latestArrival)
+		s.clock.After(s.updateLagMillis, func() {
 			s.selfState[p.GetSrc()] = state
-			s.mutex.Unlock()
-		}(p, state)
+		})
 	}
 }
 
@@ -80,6 +84,25 @@ func (s *BestNeighborSimulator) GetRoutedPackets(packet Packet, outgoingAddr Add
 		newPacket := packet.Copy()
 		newPacket.SetDst(bestNeighbor)
 		packets = append(packets, newPacket)
+
+		if _, ok := s.stats.Picks[outgoingAddr]; !ok {
+			s.stats.Picks[outgoingAddr] = make(map[Address]int)
+		}
+		s.stats.Picks[outgoingAddr][bestNeighbor]++
 	}
+	s.stats.Routed++
+	s.stats.Copies += len(packets)
 	return packets
 }
+
+// Stats returns a copy of the router's counters.
+func (s *BestNeighborSimulator) Stats() RouterStats {
+	stats := RouterStats{Routed: s.stats.Routed, Copies: s.stats.Copies, Picks: make(map[Address]map[Address]int)}
+	for src, picks := range s.stats.Picks {
+		stats.Picks[src] = make(map[Address]int)
+		for dst, count := range picks {
+			stats.Picks[src][dst] = count
+		}
+	}
+	return stats
+}
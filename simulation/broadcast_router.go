@@ -2,12 +2,17 @@ package simulation
 
 type BroadcastSimulator struct {
 	neighbors NeighborMap
+	stats     RouterStats
 }
 
 func NewBroadcastSimulator(neighbors NeighborMap) *BroadcastSimulator {
 	return &BroadcastSimulator{neighbors: neighbors}
 }
 
+func (s *BroadcastSimulator) Name() string {
+	return "broadcast"
+}
+
 func (s *BroadcastSimulator) OnLinkDequeue(p Packet) {
 	// Do nothing
 	return
@@ -30,5 +35,11 @@ func (s *BroadcastSimulator) GetRoutedPackets(packet Packet, outgoingAddr Addres
 		newPacket.SetDst(neighbor)
 		packets = append(packets, newPacket)
 	}
+	s.stats.Routed++
+	s.stats.Copies += len(packets)
 	return packets
 }
+
+func (s *BroadcastSimulator) Stats() RouterStats {
+	return s.stats
+}
@@ -0,0 +1,74 @@
+package simulation
+
+import (
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// AnyDSCP makes a FlowRule match packets with any DSCP value.
+const AnyDSCP = -1
+
+// FlowRule assigns packets to the drone that sends them into the simulation.
+// Fields left at their zero value (and DSCP set to AnyDSCP) match any packet.
+type FlowRule struct {
+	SrcAddr  net.IP
+	Protocol layers.IPProtocol
+	SrcPort  uint16
+	DstPort  uint16
+	DSCP     int
+	Node     Address
+}
+
+func (r FlowRule) matches(decodedPacket gopacket.Packet) bool {
+	var srcAddr net.IP
+	var protocol layers.IPProtocol
+	var dscp int
+	if ipLayer := decodedPacket.Layer(layers.LayerTypeIPv4); ipLayer != nil {
+		ip := ipLayer.(*layers.IPv4)
+		srcAddr, protocol, dscp = ip.SrcIP, ip.Protocol, int(ip.TOS>>2)
+	} else if ipLayer := decodedPacket.Layer(layers.LayerTypeIPv6); ipLayer != nil {
+		ip := ipLayer.(*layers.IPv6)
+		srcAddr, protocol, dscp = ip.SrcIP, ip.NextHeader, int(ip.TrafficClass>>2)
+	} else {
+		return false
+	}
+
+	srcPort, dstPort := transportPorts(decodedPacket)
+	return (r.SrcAddr == nil || r.SrcAddr.Equal(srcAddr)) &&
+		(r.Protocol == 0 || r.Protocol == protocol) &&
+		(r.SrcPort == 0 || r.SrcPort == srcPort) &&
+		(r.DstPort == 0 || r.DstPort == dstPort) &&
+		(r.DSCP == AnyDSCP || r.DSCP == dscp)
+}
+
+// FlowClassifier picks the simulated drone each incoming packet is sent from,
+// so several applications can act as different drones in the same run.
+type FlowClassifier struct {
+	rules       []FlowRule
+	defaultNode Address
+}
+
+func NewFlowClassifier(rules []FlowRule, defaultNode Address) *FlowClassifier {
+	return &FlowClassifier{rules: rules, defaultNode: defaultNode}
+}
+
+// Classify returns the node of the first rule the packet matches, or the
+// default node if it matches none of them.
+func (c *FlowClassifier) Classify(data []byte) Address {
+	decodedPacket := decodeIP(data)
+	for _, rule := range c.rules {
+		if rule.matches(decodedPacket) {
+			return rule.Node
+		}
+	}
+	return c.defaultNode
+}
+
+func decodeIP(data []byte) gopacket.Packet {
+	if len(data) > 0 && data[0]>>4 == 6 {
+		return gopacket.NewPacket(data, layers.LayerTypeIPv6, gopacket.Default)
+	}
+	return gopacket.NewPacket(data, layers.LayerTypeIPv4, gopacket.Default)
+}
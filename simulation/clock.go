@@ -0,0 +1,257 @@
+package simulation
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+)
+
+// Clock is the source of time for a simulation run. Emulators and routers
+// never sleep; they read the current time and schedule future work through
+// the clock. Callbacks run one at a time on the goroutine that called Run, in
+// time order, and callbacks due at the same instant run in the order they
+// were scheduled.
+type Clock interface {
+	Now() time.Time
+	// At schedules f to run once the clock reaches t. It is safe to call
+	// from any goroutine.
+	At(t time.Time, f func())
+	// After schedules f to run once d has elapsed.
+	After(d time.Duration, f func())
+	// Background schedules f like At, for periodic upkeep that has nothing
+	// to do unless something else is going on. A virtual clock only runs
+	// background callbacks ahead of other callbacks, so they never move its
+	// time on their own.
+	Background(t time.Time, f func())
+	// Run executes scheduled callbacks until ctx is done.
+	Run(ctx context.Context)
+}
+
+type event struct {
+	at         time.Time
+	seq        uint64
+	f          func()
+	background bool
+}
+
+type eventHeap []*event
+
+func (h eventHeap) Len() int { return len(h) }
+
+func (h eventHeap) Less(i, j int) bool {
+	if h[i].at.Equal(h[j].at) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].at.Before(h[j].at)
+}
+
+func (h eventHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *eventHeap) Push(x interface{}) { *h = append(*h, x.(*event)) }
+
+func (h *eventHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+// eventQueue is the pending callback list shared by both clock implementations.
+type eventQueue struct {
+	mutex  sync.Mutex
+	events eventHeap
+	seq    uint64
+	wake   chan struct{}
+	// How many of the events aren't background ones
+	foreground int
+}
+
+func newEventQueue() eventQueue {
+	return eventQueue{wake: make(chan struct{}, 1)}
+}
+
+func (q *eventQueue) push(t time.Time, f func(), background bool) {
+	q.mutex.Lock()
+	heap.Push(&q.events, &event{at: t, seq: q.seq, f: f, background: background})
+	q.seq++
+	if !background {
+		q.foreground++
+	}
+	q.mutex.Unlock()
+
+	// Let a waiting Run loop know the head of the queue may have changed
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next returns the time of the earliest pending callback.
+func (q *eventQueue) next() (time.Time, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.events) == 0 {
+		return time.Time{}, false
+	}
+	return q.events[0].at, true
+}
+
+func (q *eventQueue) pop() *event {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.events) == 0 {
+		return nil
+	}
+	e := heap.Pop(&q.events).(*event)
+	if !e.background {
+		q.foreground--
+	}
+	return e
+}
+
+// popUnlessIdle is pop, except that it leaves background events where they
+// are when nothing else is pending.
+func (q *eventQueue) popUnlessIdle() *event {
+	q.mutex.Lock()
+	idle := q.foreground == 0
+	q.mutex.Unlock()
+	if idle {
+		return nil
+	}
+	return q.pop()
+}
+
+// RealClock follows the wall clock.
+type RealClock struct {
+	queue eventQueue
+}
+
+func NewRealClock() *RealClock {
+	return &RealClock{queue: newEventQueue()}
+}
+
+func (c *RealClock) Now() time.Time {
+	return time.Now()
+}
+
+func (c *RealClock) At(t time.Time, f func()) {
+	c.queue.push(t, f, false)
+}
+
+// Background is the same as At, since real time moves on regardless.
+func (c *RealClock) Background(t time.Time, f func()) {
+	c.queue.push(t, f, true)
+}
+
+func (c *RealClock) After(d time.Duration, f func()) {
+	c.At(c.Now().Add(d), f)
+}
+
+func (c *RealClock) Run(ctx context.Context) {
+	for {
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if next, ok := c.queue.next(); ok {
+			wait := next.Sub(time.Now())
+			if wait <= 0 {
+				c.queue.pop().f()
+				continue
+			}
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-c.queue.wake:
+		case <-timeout:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// VirtualClock is a discrete-event clock. Time only moves when a callback
+// runs, and it jumps straight to that callback's time, so a run finishes as
+// fast as the callbacks themselves execute and always in the same order.
+type VirtualClock struct {
+	queue eventQueue
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func NewVirtualClock(epoch time.Time) *VirtualClock {
+	return &VirtualClock{queue: newEventQueue(), now: epoch}
+}
+
+func (c *VirtualClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *VirtualClock) At(t time.Time, f func()) {
+	c.push(t, f, false)
+}
+
+func (c *VirtualClock) Background(t time.Time, f func()) {
+	c.push(t, f, true)
+}
+
+func (c *VirtualClock) push(t time.Time, f func(), background bool) {
+	// Virtual time never runs backwards
+	if now := c.Now(); t.Before(now) {
+		t = now
+	}
+	c.queue.push(t, f, background)
+}
+
+func (c *VirtualClock) After(d time.Duration, f func()) {
+	c.At(c.Now().Add(d), f)
+}
+
+func (c *VirtualClock) step() bool {
+	e := c.queue.popUnlessIdle()
+	if e == nil {
+		return false
+	}
+	c.mutex.Lock()
+	// A callback scheduled from another goroutine can land just behind a
+	// time the loop has already reached
+	if e.at.After(c.now) {
+		c.now = e.at
+	}
+	c.mutex.Unlock()
+	e.f()
+	return true
+}
+
+// Run executes callbacks until ctx is done, waiting for new callbacks to be
+// scheduled whenever only background callbacks are left.
+func (c *VirtualClock) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+		if !c.step() {
+			select {
+			case <-ctx.Done():
+				return
+			case <-c.queue.wake:
+			}
+		}
+	}
+}
+
+// RunUntilIdle executes callbacks until none but background ones are left.
+func (c *VirtualClock) RunUntilIdle() {
+	for c.step() {
+	}
+}
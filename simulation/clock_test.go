@@ -0,0 +1,62 @@
+package simulation
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVirtualClockRunsInTimeOrder(t *testing.T) {
+	epoch := time.Unix(0, 0)
+	clock := NewVirtualClock(epoch)
+	var order []int
+	clock.At(epoch.Add(2*time.Second), func() { order = append(order, 2) })
+	clock.At(epoch.Add(time.Second), func() { order = append(order, 0) })
+	clock.At(epoch.Add(time.Second), func() {
+		order = append(order, 1)
+		clock.After(time.Hour, func() { order = append(order, 3) })
+	})
+
+	start := time.Now()
+	clock.RunUntilIdle()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("virtual clock took %v of real time", elapsed)
+	}
+	for i, v := range order {
+		if v != i {
+			t.Fatalf("callbacks ran out of order: %v", order)
+		}
+	}
+	if len(order) != 4 {
+		t.Fatalf("expected 4 callbacks, got %v", order)
+	}
+	if got := clock.Now().Sub(epoch); got != time.Hour+time.Second {
+		t.Fatalf("clock ended at %v after epoch", got)
+	}
+}
+
+func TestDelayEmulatorWithVirtualClock(t *testing.T) {
+	epoch := time.Unix(0, 0)
+	clock := NewVirtualClock(epoch)
+	emu := NewDelayEmulator(clock, NewDropTailQueue(10), 40*time.Millisecond, 0, 1)
+	emu.SetOnIncomingPacket(func(Packet) {})
+	var released []time.Duration
+	emu.SetOnOutgoingPacket(func(p Packet) {
+		released = append(released, clock.Now().Sub(epoch))
+	})
+	for i := 0; i < 3; i++ {
+		arrival := epoch.Add(time.Duration(i) * 10 * time.Millisecond)
+		p := &DataPacket{Id: i, ArrivalTime: arrival}
+		clock.At(arrival, func() { emu.WriteIncomingPacket(p) })
+	}
+	clock.RunUntilIdle()
+
+	expected := []time.Duration{40 * time.Millisecond, 50 * time.Millisecond, 60 * time.Millisecond}
+	if len(released) != len(expected) {
+		t.Fatalf("expected %d packets, got %d", len(expected), len(released))
+	}
+	for i := range expected {
+		if released[i] != expected[i] {
+			t.Fatalf("packet %d released at %v, expected %v", i, released[i], expected[i])
+		}
+	}
+}
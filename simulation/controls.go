@@ -0,0 +1,219 @@
+package simulation
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var errNoLink = errors.New("no such link")
+var errNoNode = errors.New("no links to or from that node")
+
+// Controls changes a running simulator from a callback on its clock loop.
+// The simulator's own methods for these changes wait for the loop, so they
+// can't be used there.
+type Controls struct {
+	s *BaseSimulator
+}
+
+// Schedule hands f the simulator's Controls once the clock reaches t.
+func (s *BaseSimulator) Schedule(t time.Time, f func(Controls)) {
+	s.clock.At(t, func() { f(Controls{s}) })
+}
+
+// Apply runs f with the simulator's Controls on its clock loop, and returns
+// once it has. Anything f reads that the loop changes, such as the neighbors
+// mobility tracking keeps up to date, is safe to use there.
+func (s *BaseSimulator) Apply(f func(Controls)) {
+	s.onLoop(func() { f(Controls{s}) })
+}
+
+// Returns the path the link from src to dst is on.
+func (s *BaseSimulator) pathOf(src Address, dst Address) (*path, error) {
+	for _, p := range []*path{&s.forward, &s.reverse} {
+		if _, ok := p.queues[src][dst]; ok {
+			return p, nil
+		}
+	}
+	return nil, errNoLink
+}
+
+func (p *path) setDown(src Address, dst Address, down bool) {
+	if p.down == nil {
+		p.down = make(map[Address]map[Address]bool)
+	}
+	if p.down[src] == nil {
+		p.down[src] = make(map[Address]bool)
+	}
+	p.down[src][dst] = down
+}
+
+// TakeLinkDown makes the link from src to dst drop every packet routed onto
+// it until BringLinkUp is called. Packets already on it are still delivered.
+func (c Controls) TakeLinkDown(src Address, dst Address) error {
+	return c.setLinkDown(src, dst, true)
+}
+
+// BringLinkUp undoes TakeLinkDown.
+func (c Controls) BringLinkUp(src Address, dst Address) error {
+	return c.setLinkDown(src, dst, false)
+}
+
+func (c Controls) setLinkDown(src Address, dst Address, down bool) error {
+	p, err := c.s.pathOf(src, dst)
+	if err != nil {
+		return err
+	}
+	p.setDown(src, dst, down)
+	event := "link_up"
+	if down {
+		event = "link_down"
+	}
+	log.WithFields(log.Fields{
+		"event":  event,
+		"src":    src,
+		"dst":    dst,
+		"return": p.isReturn,
+	}).WithTime(c.s.clock.Now()).Info()
+	return nil
+}
+
+// TakeNodeDown takes down every link to and from node, in both directions,
+// as if it had left the network.
+func (c Controls) TakeNodeDown(node Address) error {
+	return c.setNodeDown(node, true)
+}
+
+// BringNodeUp brings every link to and from node back up.
+func (c Controls) BringNodeUp(node Address) error {
+	return c.setNodeDown(node, false)
+}
+
+func (c Controls) setNodeDown(node Address, down bool) error {
+	found := false
+	for _, p := range []*path{&c.s.forward, &c.s.reverse} {
+		for src, links := range p.queues {
+			for dst := range links {
+				if src == node || dst == node {
+					p.setDown(src, dst, down)
+					found = true
+				}
+			}
+		}
+	}
+	if !found {
+		return errNoNode
+	}
+	event := "node_up"
+	if down {
+		event = "node_down"
+	}
+	log.WithFields(log.Fields{
+		"event": event,
+		"node":  node,
+	}).WithTime(c.s.clock.Now()).Info()
+	return nil
+}
+
+// ReplaceLink swaps the link between linkConfig's source and destination for
+// a new one built from linkConfig. New packets go onto the new link, while
+// the packets already on the old one are still delivered.
+func (c Controls) ReplaceLink(linkConfig LinkConfig) error {
+	if _, err := c.s.pathOf(linkConfig.SrcAddr(), linkConfig.DstAddr()); err != nil {
+		return err
+	}
+	return c.replaceLink(linkConfig.ToLinkEmulator(c.s.replacementEnv(linkConfig)))
+}
+
+// Returns the environment the next replacement of linkConfig's link is built
+// in. Each replacement draws random numbers from a stream of its own, rather
+// than repeating the draws the link it replaces started from. Only called on
+// the clock loop.
+func (s *BaseSimulator) replacementEnv(linkConfig LinkConfig) LinkEnvironment {
+	src, dst := linkConfig.SrcAddr(), linkConfig.DstAddr()
+	if s.replacements == nil {
+		s.replacements = make(map[Address]map[Address]int)
+	}
+	if s.replacements[src] == nil {
+		s.replacements[src] = make(map[Address]int)
+	}
+	s.replacements[src][dst]++
+	env := s.env
+	env.Seed = newStageRand(s.env.Seed, src, dst, fmt.Sprintf("replacement %d", s.replacements[src][dst])).Int63()
+	return env
+}
+
+func (c Controls) replaceLink(emu LinkEmulator) error {
+	p, err := c.s.pathOf(emu.SrcAddr(), emu.DstAddr())
+	if err != nil {
+		return err
+	}
+	p.retired = append(p.retired, p.queues[emu.SrcAddr()][emu.DstAddr()])
+	c.s.wireLink(p, emu)
+	p.queues[emu.SrcAddr()][emu.DstAddr()] = emu
+	log.WithFields(log.Fields{
+		"event":  "link_replaced",
+		"src":    emu.SrcAddr(),
+		"dst":    emu.DstAddr(),
+		"return": p.isReturn,
+	}).WithTime(c.s.clock.Now()).Info()
+	return nil
+}
+
+// ReplaceRouter switches the router that carries traffic to the base. Copies
+// of a packet that are already on the links are routed by the new router from
+// their next hop onwards. The new router's counters carry on from the old
+// one's.
+func (c Controls) ReplaceRouter(rs RoutingSimulator) {
+	log.WithFields(log.Fields{
+		"event":    "router_replaced",
+		"previous": c.s.forward.router.Name(),
+		"routing":  rs.Name(),
+	}).WithTime(c.s.clock.Now()).Info()
+	c.s.forward.retiredRouters.add(c.s.forward.router.Stats())
+	c.s.forward.router = rs
+}
+
+// The methods below make the same changes from any goroutine once the
+// simulator has been started, waiting for the clock loop to make them.
+
+func (s *BaseSimulator) TakeLinkDown(src Address, dst Address) error {
+	var err error
+	s.onLoop(func() { err = Controls{s}.TakeLinkDown(src, dst) })
+	return err
+}
+
+func (s *BaseSimulator) BringLinkUp(src Address, dst Address) error {
+	var err error
+	s.onLoop(func() { err = Controls{s}.BringLinkUp(src, dst) })
+	return err
+}
+
+func (s *BaseSimulator) TakeNodeDown(node Address) error {
+	var err error
+	s.onLoop(func() { err = Controls{s}.TakeNodeDown(node) })
+	return err
+}
+
+func (s *BaseSimulator) BringNodeUp(node Address) error {
+	var err error
+	s.onLoop(func() { err = Controls{s}.BringNodeUp(node) })
+	return err
+}
+
+func (s *BaseSimulator) ReplaceLink(linkConfig LinkConfig) error {
+	var env LinkEnvironment
+	s.onLoop(func() { env = s.replacementEnv(linkConfig) })
+	// Built here rather than on the loop, since reading a trace can take a
+	// while
+	emu := linkConfig.ToLinkEmulator(env)
+	var err error
+	s.onLoop(func() { err = Controls{s}.replaceLink(emu) })
+	return err
+}
+
+func (s *BaseSimulator) ReplaceRouter(rs RoutingSimulator) {
+	s.onLoop(func() { Controls{s}.ReplaceRouter(rs) })
+}
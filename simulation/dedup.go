@@ -0,0 +1,34 @@
+package simulation
+
+// DuplicateFilter remembers the ids of the most recently delivered packets so
+// that copies made by the routers only reach the destination once.
+type DuplicateFilter struct {
+	seen   map[int]bool
+	recent []int // Ring buffer of the ids in seen, oldest first from next
+	next   int
+}
+
+// NewDuplicateFilter remembers up to window packet ids.
+func NewDuplicateFilter(window int) *DuplicateFilter {
+	return &DuplicateFilter{
+		seen:   make(map[int]bool),
+		recent: make([]int, 0, window),
+	}
+}
+
+// IsDuplicate reports whether a packet with this id was already delivered,
+// and remembers the id if it wasn't.
+func (f *DuplicateFilter) IsDuplicate(id int) bool {
+	if f.seen[id] {
+		return true
+	}
+	if len(f.recent) < cap(f.recent) {
+		f.recent = append(f.recent, id)
+	} else {
+		delete(f.seen, f.recent[f.next])
+		f.recent[f.next] = id
+		f.next = (f.next + 1) % len(f.recent)
+	}
+	f.seen[id] = true
+	return false
+}
@@ -0,0 +1,134 @@
+package simulation
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DelayDistribution is where a delay link draws each packet's delay from.
+// Draws below 0 count as 0.
+type DelayDistribution interface {
+	Sample(rng *rand.Rand) time.Duration
+}
+
+// ConstantDelay gives every packet the same delay.
+type ConstantDelay time.Duration
+
+func (d ConstantDelay) Sample(rng *rand.Rand) time.Duration {
+	return time.Duration(d)
+}
+
+type NormalDelay struct {
+	Mean   time.Duration
+	StdDev time.Duration
+}
+
+func (d NormalDelay) Sample(rng *rand.Rand) time.Duration {
+	return nonNegative(float64(d.Mean) + rng.NormFloat64()*float64(d.StdDev))
+}
+
+// LogNormalDelay is a log-normal distribution with the given mean and
+// standard deviation, rather than those of the delay's logarithm.
+type LogNormalDelay struct {
+	Mean   time.Duration
+	StdDev time.Duration
+}
+
+func (d LogNormalDelay) Sample(rng *rand.Rand) time.Duration {
+	mean, stdDev := float64(d.Mean), float64(d.StdDev)
+	sigma := math.Sqrt(math.Log(1 + stdDev*stdDev/(mean*mean)))
+	mu := math.Log(mean) - sigma*sigma/2
+	return nonNegative(math.Exp(mu + sigma*rng.NormFloat64()))
+}
+
+// ParetoDelay never goes below Scale, and has a heavier tail the smaller
+// Shape is. Below a Shape of 1 its mean is infinite.
+type ParetoDelay struct {
+	Scale time.Duration
+	Shape float64
+}
+
+func (d ParetoDelay) Sample(rng *rand.Rand) time.Duration {
+	// 1 - Float64 is never 0
+	return nonNegative(float64(d.Scale) * math.Pow(1-rng.Float64(), -1/d.Shape))
+}
+
+type UniformDelay struct {
+	Min time.Duration
+	Max time.Duration
+}
+
+func (d UniformDelay) Sample(rng *rand.Rand) time.Duration {
+	return nonNegative(float64(d.Min) + rng.Float64()*float64(d.Max-d.Min))
+}
+
+// EmpiricalDelay draws from a histogram of recorded delays.
+type EmpiricalDelay struct {
+	delays []time.Duration
+	// Running total of the weights, up to and including each delay
+	cumulative []float64
+}
+
+// LoadEmpiricalDelay reads a histogram file, where each line is "delay_ms" or
+// "delay_ms weight". A line without a weight counts once, so a file of raw
+// samples works as well.
+func LoadEmpiricalDelay(filename string) EmpiricalDelay {
+	file, err := os.Open(filename)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	var d EmpiricalDelay
+	total := 0.0
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		} else if len(fields) > 2 {
+			panic(fmt.Sprintf("bad histogram line %q in %s", scanner.Text(), filename))
+		}
+		delay, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			panic(err)
+		}
+		weight := 1.0
+		if len(fields) == 2 {
+			if weight, err = strconv.ParseFloat(fields[1], 64); err != nil {
+				panic(err)
+			}
+		}
+		if weight < 0 {
+			panic(fmt.Sprintf("negative weight in %s", filename))
+		}
+		total += weight
+		d.delays = append(d.delays, time.Duration(delay*float64(time.Millisecond)))
+		d.cumulative = append(d.cumulative, total)
+	}
+	if total == 0 {
+		panic(fmt.Sprintf("no delays in %s", filename))
+	}
+	return d
+}
+
+func (d EmpiricalDelay) Sample(rng *rand.Rand) time.Duration {
+	target := rng.Float64() * d.cumulative[len(d.cumulative)-1]
+	i := sort.Search(len(d.cumulative), func(i int) bool { return d.cumulative[i] > target })
+	if i == len(d.delays) {
+		// Rounding can take the target up to the total
+		i--
+	}
+	return nonNegative(float64(d.delays[i]))
+}
+
+func nonNegative(delay float64) time.Duration {
+	return time.Duration(math.Max(0, delay))
+}
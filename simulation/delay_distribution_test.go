@@ -0,0 +1,46 @@
+package simulation
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestRandomDelayOrder(t *testing.T) {
+	for _, reorder := range []bool{false, true} {
+		epoch := time.Unix(0, 0)
+		clock := NewVirtualClock(epoch)
+		delay := UniformDelay{Min: 0, Max: 100 * time.Millisecond}
+		emu := NewRandomDelayEmulator(clock, rand.New(rand.NewSource(1)), NewDropTailQueue(100), delay, reorder, noLoss{}, 0, 1)
+		emu.SetOnIncomingPacket(func(Packet) {})
+		var ids []int
+		var arrivals []time.Duration
+		emu.SetOnOutgoingPacket(func(p Packet) {
+			ids = append(ids, p.GetId())
+			arrivals = append(arrivals, clock.Now().Sub(epoch))
+		})
+		for i := 0; i < 50; i++ {
+			arrival := epoch.Add(time.Duration(i) * time.Millisecond)
+			p := &DataPacket{Id: i, ArrivalTime: arrival}
+			clock.At(arrival, func() { emu.WriteIncomingPacket(p) })
+		}
+		clock.RunUntilIdle()
+
+		if len(ids) != 50 {
+			t.Fatalf("expected 50 packets with reorder %v, got %d", reorder, len(ids))
+		}
+		reordered := false
+		for i := 1; i < len(ids); i++ {
+			if arrivals[i] < arrivals[i-1] {
+				t.Fatalf("packets arrived out of time order with reorder %v", reorder)
+			}
+			reordered = reordered || ids[i] < ids[i-1]
+		}
+		if reordered != reorder {
+			t.Fatalf("expected reordering %v, got order %v", reorder, ids)
+		}
+		if stats := emu.Stats(); stats.Queued != 0 {
+			t.Fatalf("expected nothing left queued, got %d", stats.Queued)
+		}
+	}
+}
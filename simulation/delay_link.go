@@ -1,56 +1,114 @@
 package simulation
 
 import (
+	"math/rand"
 	"time"
 )
 
 type DelayEmulator struct {
-	inputQueue             chan Packet
-	outputQueue            chan Packet
-	delay                  time.Duration
+	clock                  Clock
+	rand                   *rand.Rand
+	queue                  QueueDiscipline
+	delay                  DelayDistribution
+	reorder                bool
+	loss                   LossModel
 	src                    Address
 	dst                    Address
 	incomingPacketCallback func(Packet)
+	outgoingPacketCallback func(Packet)
+	droppedPacketCallback  func(Packet, DropReason)
+	counters               linkCounters
+	// When the last packet is due to arrive, so the next can't overtake it
+	lastArrival time.Time
+	// Packets that left the queue but have yet to arrive
+	inFlight int
 }
 
-func NewDelayEmulator(maxQueueLength int, delay time.Duration, src Address, dst Address) DelayEmulator {
-	return DelayEmulator{
-		inputQueue:  make(chan Packet, maxQueueLength),
-		outputQueue: make(chan Packet, maxQueueLength),
-		delay:       delay,
-		src:         src,
-		dst:         dst}
+// Packets stay in queue for as long as they are in flight, but the delay is
+// time on the wire rather than time waiting, so the queue sees none of it.
+func NewDelayEmulator(clock Clock, queue QueueDiscipline, delay time.Duration, src Address, dst Address) *DelayEmulator {
+	return NewRandomDelayEmulator(clock, nil, queue, ConstantDelay(delay), false, noLoss{}, src, dst)
 }
 
-func (e *DelayEmulator) ApplyEmulation() {
-	p := e.readIncomingPacket()
-	releaseTime := p.GetArrivalTime().Add(e.delay)
-	delay := releaseTime.Sub(time.Now())
-	if delay > 0 {
-		time.Sleep(delay)
-	}
-	e.outputQueue <- p
+// NewRandomDelayEmulator draws each packet's delay from delay. Unless reorder
+// is set, a packet that draws a shorter delay than the one before it waits
+// to arrive right after it. Packets that may be reordered can't stay in
+// queue while in flight, as they no longer leave in the order they came, so
+// they leave it as soon as they are queued and the queue's limit doesn't
+// apply to them. Whether a packet is lost is decided as it is sent, and it is
+// dropped when it would have arrived.
+func NewRandomDelayEmulator(clock Clock, rng *rand.Rand, queue QueueDiscipline, delay DelayDistribution, reorder bool, loss LossModel, src Address, dst Address) *DelayEmulator {
+	e := &DelayEmulator{
+		clock:    clock,
+		rand:     rng,
+		queue:    queue,
+		delay:    delay,
+		reorder:  reorder,
+		loss:     loss,
+		src:      src,
+		dst:      dst,
+		counters: newLinkCounters()}
+	queue.SetOnDroppedPacket(func(p Packet, reason DropReason) {
+		e.counters.countDrop(reason)
+		e.droppedPacketCallback(p, reason)
+	})
+	return e
 }
 
 func (e *DelayEmulator) SetOnIncomingPacket(callback func(Packet)) {
 	e.incomingPacketCallback = callback
 }
 
-func (e *DelayEmulator) readIncomingPacket() Packet {
-	p := <-e.inputQueue
-	e.incomingPacketCallback(p)
-	return p
+func (e *DelayEmulator) SetOnOutgoingPacket(callback func(Packet)) {
+	e.outgoingPacketCallback = callback
+}
+
+func (e *DelayEmulator) SetOnDroppedPacket(callback func(Packet, DropReason)) {
+	e.droppedPacketCallback = callback
 }
 
 func (e *DelayEmulator) WriteIncomingPacket(p Packet) {
-	select {
-	case e.inputQueue <- p:
-	default:
+	if !e.queue.Enqueue(p, e.clock.Now()) {
+		return
+	}
+	e.counters.countIn(p)
+	e.incomingPacketCallback(p)
+	arrival := p.GetArrivalTime().Add(e.delay.Sample(e.rand))
+	lost := e.loss.Drop(p.GetArrivalTime())
+	if e.reorder {
+		if p := e.queue.Dequeue(p.GetArrivalTime()); p != nil {
+			e.inFlight++
+			e.clock.At(arrival, func() {
+				e.inFlight--
+				e.deliver(p, lost)
+			})
+		}
+		return
 	}
+
+	if arrival.Before(e.lastArrival) {
+		arrival = e.lastArrival
+	}
+	e.lastArrival = arrival
+	queued := p.GetArrivalTime()
+	e.clock.At(arrival, func() {
+		// Packets arrive in the order they were queued, so this one is at
+		// the head. Its time waiting for the one ahead of it is on the wire
+		// too.
+		if p := e.queue.Dequeue(queued); p != nil {
+			e.deliver(p, lost)
+		}
+	})
 }
 
-func (e *DelayEmulator) ReadOutgoingPacket() Packet {
-	return <-e.outputQueue
+func (e *DelayEmulator) deliver(p Packet, lost bool) {
+	if lost {
+		e.counters.countDrop(e.loss.Reason())
+		e.droppedPacketCallback(p, e.loss.Reason())
+		return
+	}
+	e.counters.countOut(p)
+	e.outgoingPacketCallback(p)
 }
 
 func (e *DelayEmulator) SrcAddr() Address {
@@ -60,3 +118,9 @@ func (e *DelayEmulator) SrcAddr() Address {
 func (e *DelayEmulator) DstAddr() Address {
 	return e.dst
 }
+
+func (e *DelayEmulator) Stats() LinkStats {
+	stats := e.counters.stats(e.src, e.dst, e.queue)
+	stats.Queued += e.inFlight
+	return stats
+}
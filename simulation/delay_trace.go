@@ -0,0 +1,89 @@
+package simulation
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DelayTrace gives each packet the one-way delay recorded at the point of
+// the trace it arrives at, such as delays measured with timestamped probes.
+// The trace starts at base and loops once it reaches its last offset. Between
+// two rows the delay is that of the earlier one, or moves linearly from one
+// to the other if interpolate is set.
+type DelayTrace struct {
+	clock       Clock
+	base        time.Time
+	offsets     []time.Duration
+	delays      []time.Duration
+	interpolate bool
+}
+
+// LoadDelayTrace reads a delay trace, where each line is "offset_ms
+// delay_ms" with the offsets in order. The last line's offset is how long
+// the trace lasts.
+func LoadDelayTrace(clock Clock, base time.Time, filename string, interpolate bool) *DelayTrace {
+	file, err := os.Open(filename)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	d := &DelayTrace{clock: clock, base: base, interpolate: interpolate}
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		} else if len(fields) != 2 {
+			panic(fmt.Sprintf("bad delay trace line %q in %s", scanner.Text(), filename))
+		}
+		offset, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			panic(err)
+		}
+		delay, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			panic(err)
+		}
+		d.offsets = append(d.offsets, time.Duration(offset*float64(time.Millisecond)))
+		d.delays = append(d.delays, time.Duration(delay*float64(time.Millisecond)))
+		if n := len(d.offsets); n > 1 && d.offsets[n-1] < d.offsets[n-2] {
+			panic(fmt.Sprintf("offsets out of order in %s", filename))
+		}
+	}
+	if len(d.offsets) == 0 {
+		panic(fmt.Sprintf("no delays in %s", filename))
+	}
+	return d
+}
+
+// Sample returns the delay in effect now, which is when packets reach the
+// link.
+func (d *DelayTrace) Sample(rng *rand.Rand) time.Duration {
+	return d.delayAt(d.clock.Now())
+}
+
+func (d *DelayTrace) delayAt(now time.Time) time.Duration {
+	position := now.Sub(d.base)
+	if period := d.offsets[len(d.offsets)-1]; period > 0 {
+		position %= period
+		if position < 0 {
+			position += period
+		}
+	}
+	// The last row at or before position
+	i := sort.Search(len(d.offsets), func(i int) bool { return d.offsets[i] > position }) - 1
+	if i < 0 {
+		return nonNegative(float64(d.delays[0]))
+	} else if !d.interpolate || i == len(d.offsets)-1 {
+		return nonNegative(float64(d.delays[i]))
+	}
+	fraction := float64(position-d.offsets[i]) / float64(d.offsets[i+1]-d.offsets[i])
+	return nonNegative(float64(d.delays[i]) + fraction*float64(d.delays[i+1]-d.delays[i]))
+}
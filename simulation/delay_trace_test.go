@@ -0,0 +1,63 @@
+package simulation
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDelayTrace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	trace := filepath.Join(dir, "link.delay")
+	if err := ioutil.WriteFile(trace, []byte("0 50\n10 0\n20 30\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	epoch := time.Unix(0, 0)
+	interpolated := LoadDelayTrace(nil, epoch, trace, true)
+	for at, expected := range map[time.Duration]time.Duration{
+		5 * time.Millisecond:  25 * time.Millisecond,
+		15 * time.Millisecond: 15 * time.Millisecond,
+		// Past the end the trace starts over
+		25 * time.Millisecond: 25 * time.Millisecond,
+	} {
+		if delay := interpolated.delayAt(epoch.Add(at)); delay != expected {
+			t.Fatalf("expected an interpolated delay of %v at %v, got %v", expected, at, delay)
+		}
+	}
+
+	// The second packet is sent as the delay drops to nothing, so it only
+	// overtakes the first when the link may reorder packets
+	for reorder, expected := range map[bool][]time.Duration{
+		false: {50 * time.Millisecond, 50 * time.Millisecond},
+		true:  {10 * time.Millisecond, 50 * time.Millisecond},
+	} {
+		clock := NewVirtualClock(epoch)
+		config := NewDelayTraceLinkConfig(trace, false, reorder, LossConfig{}, QueueConfig{}, 0, 1)
+		link := config.ToLinkEmulator(LinkEnvironment{Clock: clock, MaxQueueLength: 10, Seed: 1, Epoch: epoch})
+		link.SetOnIncomingPacket(func(Packet) {})
+		link.SetOnDroppedPacket(func(Packet, DropReason) { t.Fatal("unexpected drop") })
+		var arrivals []time.Duration
+		link.SetOnOutgoingPacket(func(Packet) { arrivals = append(arrivals, clock.Now().Sub(epoch)) })
+		for i, at := range []time.Duration{0, 10 * time.Millisecond} {
+			p := &DataPacket{Id: i, ArrivalTime: epoch.Add(at)}
+			clock.At(epoch.Add(at), func() { link.WriteIncomingPacket(p) })
+		}
+		clock.RunUntilIdle()
+
+		if len(arrivals) != len(expected) {
+			t.Fatalf("expected arrivals at %v with reorder %v, got %v", expected, reorder, arrivals)
+		}
+		for i := range expected {
+			if arrivals[i] != expected[i] {
+				t.Fatalf("expected arrivals at %v with reorder %v, got %v", expected, reorder, arrivals)
+			}
+		}
+	}
+}
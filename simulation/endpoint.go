@@ -0,0 +1,98 @@
+package simulation
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+var errSinkFull = errors.New("sink channel is full")
+
+// PacketSource supplies the raw IP packets that enter the simulation.
+type PacketSource interface {
+	// ReadPacket blocks until the next packet is available and returns it
+	// along with the time it was received. It returns io.EOF once the source
+	// is exhausted.
+	ReadPacket() ([]byte, time.Time, error)
+	// Close is safe to call more than once.
+	Close() error
+}
+
+// PacketSink receives the raw IP packets that leave the simulation.
+type PacketSink interface {
+	// WritePacket delivers a packet at simulation time t.
+	WritePacket(data []byte, t time.Time) error
+	Close() error
+}
+
+type TimedPacket struct {
+	Data []byte
+	Time time.Time
+}
+
+// ChannelSource lets a program running the simulator as a library hand it
+// packets directly.
+type ChannelSource struct {
+	packets chan TimedPacket
+	once    sync.Once
+}
+
+func NewChannelSource(capacity int) *ChannelSource {
+	return &ChannelSource{packets: make(chan TimedPacket, capacity)}
+}
+
+// Write queues a packet that was received at time t. It must not be called
+// after Close.
+func (s *ChannelSource) Write(data []byte, t time.Time) {
+	s.packets <- TimedPacket{Data: data, Time: t}
+}
+
+func (s *ChannelSource) ReadPacket() ([]byte, time.Time, error) {
+	p, ok := <-s.packets
+	if !ok {
+		return nil, time.Time{}, io.EOF
+	}
+	return p.Data, p.Time, nil
+}
+
+// Close marks the end of the packets. Packets already written can still be
+// read.
+func (s *ChannelSource) Close() error {
+	s.once.Do(func() {
+		close(s.packets)
+	})
+	return nil
+}
+
+// ChannelSink exposes delivered packets on a channel. Deliveries are dropped,
+// and reported as failed writes, rather than blocking the simulation if the
+// channel is full.
+type ChannelSink struct {
+	packets chan TimedPacket
+	once    sync.Once
+}
+
+func NewChannelSink(capacity int) *ChannelSink {
+	return &ChannelSink{packets: make(chan TimedPacket, capacity)}
+}
+
+func (s *ChannelSink) Packets() <-chan TimedPacket {
+	return s.packets
+}
+
+func (s *ChannelSink) WritePacket(data []byte, t time.Time) error {
+	select {
+	case s.packets <- TimedPacket{Data: data, Time: t}:
+	default:
+		return errSinkFull
+	}
+	return nil
+}
+
+func (s *ChannelSink) Close() error {
+	s.once.Do(func() {
+		close(s.packets)
+	})
+	return nil
+}
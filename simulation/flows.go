@@ -0,0 +1,70 @@
+package simulation
+
+import (
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Identifies a flow from the drone's side: its own port and the address and
+// port of the host on the other side of the base.
+type flowKey struct {
+	protocol   layers.IPProtocol
+	localPort  uint16
+	remoteAddr string
+	remotePort uint16
+}
+
+// Where a flow entered the simulation
+type flowOrigin struct {
+	node     Address
+	realAddr net.IP
+}
+
+type flowTable map[flowKey]flowOrigin
+
+func transportPorts(decodedPacket gopacket.Packet) (uint16, uint16) {
+	if udpLayer := decodedPacket.Layer(layers.LayerTypeUDP); udpLayer != nil {
+		udp := udpLayer.(*layers.UDP)
+		return uint16(udp.SrcPort), uint16(udp.DstPort)
+	} else if tcpLayer := decodedPacket.Layer(layers.LayerTypeTCP); tcpLayer != nil {
+		tcp := tcpLayer.(*layers.TCP)
+		return uint16(tcp.SrcPort), uint16(tcp.DstPort)
+	}
+	return 0, 0
+}
+
+// Must be called before the packet's source address is rewritten
+func (t flowTable) record(decodedPacket gopacket.Packet, node Address) {
+	srcAddr, dstAddr, protocol, ok := ipHeader(decodedPacket)
+	if !ok {
+		return
+	}
+	srcPort, dstPort := transportPorts(decodedPacket)
+	key := flowKey{
+		protocol:   protocol,
+		localPort:  srcPort,
+		remoteAddr: dstAddr.String(),
+		remotePort: dstPort,
+	}
+	realAddr := make(net.IP, len(srcAddr))
+	copy(realAddr, srcAddr)
+	t[key] = flowOrigin{node: node, realAddr: realAddr}
+}
+
+func (t flowTable) lookupReturn(decodedPacket gopacket.Packet) (flowOrigin, bool) {
+	srcAddr, _, protocol, ok := ipHeader(decodedPacket)
+	if !ok {
+		return flowOrigin{}, false
+	}
+	srcPort, dstPort := transportPorts(decodedPacket)
+	key := flowKey{
+		protocol:   protocol,
+		localPort:  dstPort,
+		remoteAddr: srcAddr.String(),
+		remotePort: srcPort,
+	}
+	origin, ok := t[key]
+	return origin, ok
+}
@@ -1,161 +1,566 @@
 package simulation
 
 import (
-	"fmt"
+	"context"
 	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	log "github.com/sirupsen/logrus"
-	"github.com/songgao/water"
 )
 
 type Simulator interface {
-	Start(linkConfigs []LinkConfig)
-	ProcessOutgoingPackets()
-	ProcessIncomingPackets()
+	Start(ctx context.Context, linkConfigs []LinkConfig, maxQueueLength int)
+	Stop(ctx context.Context)
+	WriteNewPacket(packet Packet, source Address)
+	WriteReturnPacket(packet Packet)
 	writeToDestination(Packet)
 }
 
+// The links and router that carry traffic in one direction
+type path struct {
+	queues     map[Address](map[Address]LinkEmulator) // Map src to list of links
+	router     RoutingSimulator
+	duplicates *DuplicateFilter
+	isReturn   bool
+	drops      map[DropReason]int
+	// Links taken down mid-run, which drop every packet routed onto them
+	down map[Address]map[Address]bool
+	// Links replaced mid-run, which still deliver what was already on them
+	retired []LinkEmulator
+	// What the routers replaced mid-run did before they were replaced
+	retiredRouters RouterStats
+}
+
 type BaseSimulator struct {
-	queues   map[Address](map[Address]LinkEmulator) // Map src to list of links
-	realDest int
-	tun      *water.Interface
-	tunDest  net.IP
-	router   RoutingSimulator
+	// Packets written to the simulator that haven't been routed yet, which
+	// Stop waits for too. Changed atomically, and first so that it is
+	// aligned for that.
+	unrouted      int64
+	forward       path // Drones to the base
+	reverse       path // The base back to the drones
+	reverseLinks  []LinkConfig
+	realDest      int
+	sink          PacketSink
+	tunDest       net.IP
+	tunDest6      net.IP
+	flows         flowTable
+	defaultReturn flowOrigin
+	clock         Clock
+	seed          int64
+	env           LinkEnvironment
+	// Packets dropped because they couldn't be rewritten
+	unsupportedPackets int
+	// Deliveries the sink failed to write
+	sinkErrors int
+	// Stops the clock loop, which closes done once it has returned
+	cancel context.CancelFunc
+	done   chan struct{}
+	// Set while Stop waits for the links to empty, and closed once they have
+	drained chan struct{}
+	// Counts the times the simulator has been started
+	run int
+	// How many times each link has been replaced this run
+	replacements map[Address]map[Address]int
+}
+
+// runClock is the clock as one run of the simulator sees it. Callbacks
+// scheduled through it are dropped once the simulator has been started
+// again, so what was left on the links of a run stopped without draining
+// never reaches the next one.
+type runClock struct {
+	Clock
+	s   *BaseSimulator
+	run int
+}
+
+func (c runClock) At(t time.Time, f func()) {
+	c.Clock.At(t, func() {
+		if c.s.run == c.run {
+			f()
+			// Anything the links do can be what empties them
+			c.s.checkDrained()
+		}
+	})
 }
 
-func NewSimulator(baseAddress Address, device *water.Interface, deviceDstAddr net.IP) BaseSimulator {
+func (c runClock) After(d time.Duration, f func()) {
+	c.At(c.Now().Add(d), f)
+}
+
+func (c runClock) Background(t time.Time, f func()) {
+	c.Clock.Background(t, func() {
+		if c.s.run == c.run {
+			f()
+		}
+	})
+}
+
+// Packets that reach the base have their source rewritten to deviceDstAddr
+// and are delivered to sink.
+func NewSimulator(clock Clock, baseAddress Address, sink PacketSink, deviceDstAddr net.IP) BaseSimulator {
 	return BaseSimulator{
-		queues:   make(map[Address](map[Address]LinkEmulator)),
+		forward:  path{queues: make(map[Address](map[Address]LinkEmulator)), drops: make(map[DropReason]int)},
+		reverse:  path{queues: make(map[Address](map[Address]LinkEmulator)), drops: make(map[DropReason]int), isReturn: true},
 		realDest: baseAddress,
-		tun:      device,
+		sink:     sink,
 		tunDest:  deviceDstAddr,
+		flows:    make(flowTable),
+		clock:    clock,
 	}
 }
 
+// SetIPv6Address sets the address IPv6 packets that reach the base have
+// their source rewritten to. Without it, IPv6 packets are dropped.
+func (s *BaseSimulator) SetIPv6Address(deviceDstAddr net.IP) {
+	s.tunDest6 = deviceDstAddr
+}
+
+// UnsupportedPackets returns how many packets have been dropped because they
+// couldn't be rewritten for the real network. Like Snapshot, it is safe to
+// call from any goroutine.
+func (s *BaseSimulator) UnsupportedPackets() int {
+	var unsupported int
+	s.onLoop(func() { unsupported = s.unsupportedPackets })
+	return unsupported
+}
+
+// SinkErrors returns how many delivered packets the sink failed to write.
+// Like Snapshot, it is safe to call from any goroutine.
+func (s *BaseSimulator) SinkErrors() int {
+	var sinkErrors int
+	s.onLoop(func() { sinkErrors = s.sinkErrors })
+	return sinkErrors
+}
+
 func (s *BaseSimulator) SetRouter(rs RoutingSimulator) {
-	s.router = rs
+	s.forward.router = rs
+	s.forward.retiredRouters = RouterStats{}
+}
+
+// SetReturnLinks sets up the path that carries traffic from the base back to
+// the drones. Without it, return traffic can't enter the simulation.
+func (s *BaseSimulator) SetReturnLinks(linkConfigs []LinkConfig, rs RoutingSimulator) {
+	s.reverseLinks = linkConfigs
+	s.reverse.router = rs
+}
+
+// SetDefaultReturnRoute sets the drone that return traffic is sent to, and
+// the real address it is delivered to, when it doesn't belong to a flow that
+// has already been seen going to the base.
+func (s *BaseSimulator) SetDefaultReturnRoute(node Address, realAddr net.IP) {
+	s.defaultReturn = flowOrigin{node: node, realAddr: realAddr}
+}
+
+// SetDuplicateWindow makes the simulator deliver only the first copy of each
+// packet to reach its destination, remembering the last window packets in
+// each direction. A window of 0 delivers every copy.
+func (s *BaseSimulator) SetDuplicateWindow(window int) {
+	if window == 0 {
+		s.forward.duplicates = nil
+		s.reverse.duplicates = nil
+		return
+	}
+	s.forward.duplicates = NewDuplicateFilter(window)
+	s.reverse.duplicates = NewDuplicateFilter(window)
+}
+
+// SetSeed sets the seed every link's random number generator is derived from.
+// Two runs with the same seed, configuration and inputs make the same random
+// decisions.
+func (s *BaseSimulator) SetSeed(seed int64) {
+	s.seed = seed
 }
 
-func (s *BaseSimulator) Start(linkConfigs []LinkConfig, maxQueueLength int) {
+// Start builds every link and runs the clock on a new goroutine until ctx is
+// done or Stop is called. A stopped simulator can be started again, with new
+// links.
+func (s *BaseSimulator) Start(ctx context.Context, linkConfigs []LinkConfig, maxQueueLength int) {
 	log.WithFields(log.Fields{
-		"event": "start_simulator",
-	}).Info()
+		"event":   "start_simulator",
+		"seed":    s.seed,
+		"routing": s.forward.router.Name(),
+	}).WithTime(s.clock.Now()).Info()
+	s.run++
+	s.replacements = nil
+	s.drained = nil
+	clock := runClock{Clock: s.clock, s: s, run: s.run}
+	s.env = LinkEnvironment{Clock: clock, MaxQueueLength: maxQueueLength, Seed: s.seed, Epoch: s.clock.Now()}
+	s.startLinks(&s.forward, linkConfigs, s.env)
+	s.startLinks(&s.reverse, s.reverseLinks, s.env)
+
+	ctx, s.cancel = context.WithCancel(ctx)
+	s.done = make(chan struct{})
+	go func() {
+		s.clock.Run(ctx)
+		close(s.done)
+	}()
+}
+
+// Stop waits for every packet on the links to be delivered or dropped, or for
+// ctx to be done, whichever comes first. It then stops the clock, discarding
+// anything still on the links, and logs a summary of what each link did. An
+// already cancelled ctx stops the simulator without draining it. Stopping a
+// simulator that was never started does nothing.
+func (s *BaseSimulator) Stop(ctx context.Context) {
+	if s.done == nil {
+		return
+	}
+	drained := make(chan struct{})
+	if ctx.Err() == nil {
+		s.env.Clock.At(s.clock.Now(), func() { s.drained = drained })
+	}
+	select {
+	case <-drained:
+	case <-ctx.Done():
+	case <-s.done:
+	}
+	s.cancel()
+	<-s.done
+
+	// The clock loop has returned, so the links can be read from here
+	forwardStats := s.forward.stats()
+	reverseStats := s.reverse.stats()
+	flushed := s.forward.queued() + s.reverse.queued()
+	log.WithFields(log.Fields{
+		"event":        "stop_simulator",
+		"flushed":      flushed,
+		"unsupported":  s.unsupportedPackets,
+		"sink_errors":  s.sinkErrors,
+		"links":        forwardStats,
+		"return_links": reverseStats,
+	}).WithTime(s.clock.Now()).Info()
+}
+
+// Snapshot is a copy of the simulator's counters taken at one instant.
+type Snapshot struct {
+	Links        []LinkStats
+	ReturnLinks  []LinkStats
+	Router       RouterStats
+	ReturnRouter RouterStats
+	// Every packet dropped anywhere in each direction, by reason
+	Drops       map[DropReason]int
+	ReturnDrops map[DropReason]int
+}
+
+// Snapshot returns the simulator's counters. It is safe to call from any
+// goroutine.
+func (s *BaseSimulator) Snapshot() Snapshot {
+	var snapshot Snapshot
+	s.onLoop(func() { snapshot = s.snapshot() })
+	return snapshot
+}
+
+// Runs f on the clock loop and waits for it to return. Before the simulator
+// has been started, or once the loop has returned, nothing else can be using
+// the simulator, so f runs here instead.
+func (s *BaseSimulator) onLoop(f func()) {
+	if s.done == nil {
+		f()
+		return
+	}
+	var once sync.Once
+	ran := make(chan struct{})
+	s.clock.At(s.clock.Now(), func() {
+		once.Do(f)
+		close(ran)
+	})
+	select {
+	case <-ran:
+	case <-s.done:
+		once.Do(f)
+	}
+}
+
+func (s *BaseSimulator) snapshot() Snapshot {
+	snapshot := Snapshot{
+		Links:       s.forward.stats(),
+		ReturnLinks: s.reverse.stats(),
+		Router:      s.forward.routerStats(),
+		Drops:       make(map[DropReason]int),
+		ReturnDrops: make(map[DropReason]int),
+	}
+	if s.reverse.router != nil {
+		snapshot.ReturnRouter = s.reverse.router.Stats()
+	}
+	for reason, count := range s.forward.drops {
+		snapshot.Drops[reason] = count
+	}
+	for reason, count := range s.reverse.drops {
+		snapshot.ReturnDrops[reason] = count
+	}
+	return snapshot
+}
+
+// Returns the counters of the path's router, including those of the routers
+// it replaced.
+func (p *path) routerStats() RouterStats {
+	stats := p.router.Stats()
+	stats.add(p.retiredRouters)
+	return stats
+}
+
+// Once Stop is waiting for the links to empty and no link has a packet on it,
+// closes drained and stops the clock loop. Stopping it here rather than in
+// Stop means nothing scheduled after the last packet left gets to run.
+func (s *BaseSimulator) checkDrained() {
+	if s.drained == nil || atomic.LoadInt64(&s.unrouted) > 0 || s.forward.queued()+s.reverse.queued() > 0 {
+		return
+	}
+	close(s.drained)
+	s.drained = nil
+	s.cancel()
+}
+
+// Returns how many packets are on the path's links, including replaced ones.
+func (p *path) queued() int {
+	queued := 0
+	for _, stats := range p.stats() {
+		queued += stats.Queued
+	}
+	return queued
+}
+
+// Returns the counters of every link on the path, ordered by source and
+// destination. The counts of links replaced mid-run are added to those of the
+// link that replaced them, so they never go backwards.
+func (p *path) stats() []LinkStats {
+	var allStats []LinkStats
+	for _, links := range p.queues {
+		for _, link := range links {
+			allStats = append(allStats, link.Stats())
+		}
+	}
+	for _, link := range p.retired {
+		retired := link.Stats()
+		for i := range allStats {
+			if allStats[i].Src == retired.Src && allStats[i].Dst == retired.Dst {
+				allStats[i].addRetired(retired)
+				break
+			}
+		}
+	}
+	sort.Slice(allStats, func(i, j int) bool {
+		if allStats[i].Src == allStats[j].Src {
+			return allStats[i].Dst < allStats[j].Dst
+		}
+		return allStats[i].Src < allStats[j].Src
+	})
+	return allStats
+}
+
+func (s *BaseSimulator) startLinks(p *path, linkConfigs []LinkConfig, env LinkEnvironment) {
+	p.queues = make(map[Address](map[Address]LinkEmulator))
+	p.down = nil
+	p.retired = nil
 	for _, linkConfig := range linkConfigs {
 		srcAddr := linkConfig.SrcAddr()
-		if _, ok := s.queues[srcAddr]; !ok {
-			s.queues[srcAddr] = make(map[Address]LinkEmulator)
-		}
-		emu := linkConfig.ToLinkEmulator(maxQueueLength)
-		emu.SetOnIncomingPacket(func(p Packet) {
-			s.router.OnLinkDequeue(p)
-		})
-		s.queues[srcAddr][linkConfig.DstAddr()] = emu
-	}
-	s.ProcessIncomingPackets()
-	s.ProcessOutgoingPackets()
-}
-
-func (s *BaseSimulator) ProcessIncomingPackets() {
-	for _, emulatorList := range s.queues {
-		for _, emulator := range emulatorList {
-			go func(e LinkEmulator) {
-				for {
-					// Apply emulation to packet as soon as it's received
-					s.router.OnIncomingPacket(e.SrcAddr(), e.DstAddr())
-					e.ApplyEmulation()
-				}
-			}(emulator)
+		if _, ok := p.queues[srcAddr]; !ok {
+			p.queues[srcAddr] = make(map[Address]LinkEmulator)
 		}
+		emu := linkConfig.ToLinkEmulator(env)
+		s.wireLink(p, emu)
+		p.queues[srcAddr][linkConfig.DstAddr()] = emu
 	}
 }
 
-// TODO(aditi): This is pretty heavyweight.
+// Hands everything that comes off emu back to the simulator.
+func (s *BaseSimulator) wireLink(p *path, emu LinkEmulator) {
+	emu.SetOnIncomingPacket(func(packet Packet) {
+		p.router.OnIncomingPacket(emu.SrcAddr(), emu.DstAddr())
+		p.router.OnLinkDequeue(packet)
+	})
+	emu.SetOnOutgoingPacket(func(packet Packet) {
+		s.processOutgoingPacket(p, emu, packet)
+	})
+	emu.SetOnDroppedPacket(func(packet Packet, reason DropReason) {
+		s.logDrop(p, packet, reason, emu.SrcAddr(), emu.DstAddr())
+	})
+}
+
 func (s *BaseSimulator) writeToDestination(p Packet) {
-	decodedPacket := gopacket.NewPacket(p.GetData(), layers.IPProtocolIPv4, gopacket.Default)
-	if ipLayer := decodedPacket.Layer(layers.LayerTypeIPv4); ipLayer != nil {
-		ip, _ := ipLayer.(*layers.IPv4)
-		ip.SrcIP = s.tunDest
-		buf := gopacket.NewSerializeBuffer()
-		if udpLayer := decodedPacket.Layer(layers.LayerTypeUDP); udpLayer != nil {
-			udp, _ := udpLayer.(*layers.UDP)
-			udp.SetNetworkLayerForChecksum(ip)
-			err := gopacket.SerializeLayers(
-				buf,
-				gopacket.SerializeOptions{ComputeChecksums: true},
-				ip,
-				udp,
-				gopacket.Payload(udpLayer.LayerPayload()),
-			)
-			if err != nil {
-				panic(err)
-			}
-		} else if tcpLayer := decodedPacket.Layer(layers.LayerTypeTCP); tcpLayer != nil {
-			tcp, _ := tcpLayer.(*layers.TCP)
-			tcp.SetNetworkLayerForChecksum(ip)
-			err := gopacket.SerializeLayers(
-				buf,
-				gopacket.SerializeOptions{ComputeChecksums: true},
-				ip,
-				tcp,
-				gopacket.Payload(tcpLayer.LayerPayload()),
-			)
-			if err != nil {
-				panic(err)
-			}
-		} else {
-			fmt.Println("All packet layers:")
-			for _, layer := range decodedPacket.Layers() {
-				fmt.Println("- ", layer.LayerType())
-			}
-			panic("unsupported application layer")
+	// Corruptions that keep checksums valid go in before the rewrite
+	// recomputes them, and the rest after
+	decodedPacket := decodeIP(applyCorruptions(p.GetData(), p.GetCorruptions(), true))
+	if p.GetTarget() == s.realDest {
+		// Remember where the flow came from so replies can find their way back
+		s.flows.record(decodedPacket, p.GetOrigin())
+		tunDest := s.tunDest
+		if _, ok := decodedPacket.NetworkLayer().(*layers.IPv6); ok {
+			tunDest = s.tunDest6
+		}
+		data, err := rewriteAddresses(decodedPacket, tunDest, nil)
+		if err != nil {
+			s.dropUnsupported(p, err)
+			return
 		}
+		data = applyCorruptions(data, p.GetCorruptions(), false)
 
 		log.WithFields(log.Fields{
 			"event": "packet_sent",
 			"id":    p.GetId(),
 			"src":   p.GetSrc(),
-		}).Info()
+			"path":  p.GetPath(),
+		}).WithTime(s.clock.Now()).Info()
+
+		s.writeToSink(p, data)
+	} else {
+		data, err := rewriteAddresses(decodedPacket, nil, s.returnOrigin(decodedPacket).realAddr)
+		if err != nil {
+			s.dropUnsupported(p, err)
+			return
+		}
+		data = applyCorruptions(data, p.GetCorruptions(), false)
+
+		log.WithFields(log.Fields{
+			"event": "return_packet_sent",
+			"id":    p.GetId(),
+			"src":   p.GetSrc(),
+			"dst":   p.GetTarget(),
+			"path":  p.GetPath(),
+		}).WithTime(s.clock.Now()).Info()
 
-		// TODO(aditi): Find a way to do this that uses the api
-		s.tun.Write(buf.Bytes())
+		s.writeToSink(p, data)
+	}
+}
+
+// Hands data to the sink, counting and logging a write that fails.
+func (s *BaseSimulator) writeToSink(p Packet, data []byte) {
+	if err := s.sink.WritePacket(data, s.clock.Now()); err != nil {
+		s.sinkErrors++
+		log.WithFields(log.Fields{
+			"event":  "sink_write_failed",
+			"id":     p.GetId(),
+			"src":    p.GetSrc(),
+			"return": p.GetTarget() != s.realDest,
+			"error":  err.Error(),
+		}).WithTime(s.clock.Now()).Info()
+	}
+}
+
+// Packets the simulator can't rewrite for the real network are dropped rather
+// than stopping the whole run.
+func (s *BaseSimulator) dropUnsupported(p Packet, err error) {
+	s.unsupportedPackets++
+	if p.GetTarget() == s.realDest {
+		s.forward.drops[DropUnsupportedProtocol]++
 	} else {
-		panic("unable to decode packet")
+		s.reverse.drops[DropUnsupportedProtocol]++
+	}
+	log.WithFields(log.Fields{
+		"event":  "packet_dropped",
+		"id":     p.GetId(),
+		"reason": DropUnsupportedProtocol,
+		"src":    p.GetSrc(),
+		"dst":    p.GetTarget(),
+		"return": p.GetTarget() != s.realDest,
+		"error":  err.Error(),
+	}).WithTime(s.clock.Now()).Info()
+}
+
+// Logs a packet that was dropped on, or on its way to, the link from src to
+// dst.
+func (s *BaseSimulator) logDrop(p *path, packet Packet, reason DropReason, src Address, dst Address) {
+	p.drops[reason]++
+	log.WithFields(log.Fields{
+		"event":  "packet_dropped",
+		"id":     packet.GetId(),
+		"reason": reason,
+		"src":    src,
+		"dst":    dst,
+		"return": p.isReturn,
+	}).WithTime(s.clock.Now()).Info()
+}
+
+func (s *BaseSimulator) returnOrigin(decodedPacket gopacket.Packet) flowOrigin {
+	if origin, ok := s.flows.lookupReturn(decodedPacket); ok {
+		return origin
 	}
+	return s.defaultReturn
 }
 
-func (s *BaseSimulator) routePacket(packet Packet, srcAddr Address) {
+func (s *BaseSimulator) routePacket(p *path, packet Packet, srcAddr Address) {
 	packet.SetSrc(srcAddr)
-	packets := s.router.GetRoutedPackets(packet, srcAddr)
+	packets := p.router.GetRoutedPackets(packet, srcAddr)
+	if len(packets) == 0 {
+		s.logDrop(p, packet, DropNoRoute, srcAddr, packet.GetTarget())
+	}
 	for _, packet := range packets {
-		packet.SetArrivalTime(time.Now())
-		emulator := s.queues[srcAddr][packet.GetDst()]
+		packet.SetArrivalTime(s.clock.Now())
+		emulator, ok := p.queues[srcAddr][packet.GetDst()]
+		if !ok {
+			s.logDrop(p, packet, DropNoRoute, srcAddr, packet.GetDst())
+			continue
+		} else if p.down[srcAddr][packet.GetDst()] {
+			s.logDrop(p, packet, DropLinkDown, srcAddr, packet.GetDst())
+			continue
+		}
+		packet.SetPath(append(packet.GetPath(), Hop{Src: srcAddr, Dst: packet.GetDst(), Entered: s.clock.Now()}))
 		emulator.WriteIncomingPacket(packet)
 	}
 }
 
-func (s *BaseSimulator) ProcessOutgoingPackets() {
-	for _, emulatorList := range s.queues {
-		for _, emulator := range emulatorList {
-			go func(e LinkEmulator) {
-				for {
-					packet := e.ReadOutgoingPacket()
-					s.router.OnOutgoingPacket(packet)
-					// If the emulation is complete for the "real dest", we can send it out on the real device
-					if e.DstAddr() == s.realDest {
-						s.writeToDestination(packet)
-					} else if packet.GetHopsLeft() > 0 {
-						packet.SetHopsLeft(packet.GetHopsLeft() - 1)
-						s.routePacket(packet, e.DstAddr())
-					}
-				}
-			}(emulator)
+func (s *BaseSimulator) processOutgoingPacket(p *path, e LinkEmulator, packet Packet) {
+	if path := packet.GetPath(); len(path) > 0 {
+		path[len(path)-1].Left = s.clock.Now()
+	}
+	p.router.OnOutgoingPacket(packet)
+	// If the emulation is complete for the packet's target, we can send it out on the real device
+	if e.DstAddr() == packet.GetTarget() {
+		if p.duplicates != nil && p.duplicates.IsDuplicate(packet.GetId()) {
+			log.WithFields(log.Fields{
+				"event":  "packet_duplicate",
+				"id":     packet.GetId(),
+				"src":    packet.GetSrc(),
+				"return": p.isReturn,
+			}).WithTime(s.clock.Now()).Info()
+			return
 		}
+		s.writeToDestination(packet)
+	} else if packet.GetHopsLeft() > 0 {
+		packet.SetHopsLeft(packet.GetHopsLeft() - 1)
+		s.routePacket(p, packet, e.DstAddr())
+	} else {
+		s.logDrop(p, packet, DropHopLimit, e.SrcAddr(), e.DstAddr())
 	}
 }
 
+// WriteNewPacket hands a packet sent by drone source to the simulator at the
+// current time. It is safe to call from any goroutine.
 func (s *BaseSimulator) WriteNewPacket(packet Packet, source Address) {
-	s.routePacket(packet, source)
+	packet.SetOrigin(source)
+	packet.SetTarget(s.realDest)
+	s.writePacket(func() {
+		s.routePacket(&s.forward, packet, source)
+	})
+}
+
+// WriteReturnPacket hands a packet travelling from the base back to a drone
+// to the simulator at the current time. The packet is sent to the drone its
+// flow came from. It is safe to call from any goroutine.
+func (s *BaseSimulator) WriteReturnPacket(packet Packet) {
+	s.writePacket(func() {
+		if s.reverse.router == nil {
+			s.logDrop(&s.reverse, packet, DropNoRoute, s.realDest, s.realDest)
+			return
+		}
+		packet.SetTarget(s.returnOrigin(decodeIP(packet.GetData())).node)
+		packet.SetOrigin(s.realDest)
+		s.routePacket(&s.reverse, packet, s.realDest)
+	})
+}
+
+// Runs route, which sends a packet written to the simulator on its way, on
+// the clock loop at the current time.
+func (s *BaseSimulator) writePacket(route func()) {
+	atomic.AddInt64(&s.unrouted, 1)
+	s.clock.At(s.clock.Now(), func() {
+		route()
+		atomic.AddInt64(&s.unrouted, -1)
+		s.checkDrained()
+	})
 }
@@ -0,0 +1,170 @@
+package simulation
+
+import (
+	"math/rand"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ImpairmentConfig is what happens to packets as they come off a link. Each
+// is a chance per packet.
+type ImpairmentConfig struct {
+	// Holds a packet back to leave after up to ReorderWindow of the packets
+	// behind it
+	Reorder       float64
+	ReorderWindow int
+	// Sends a second copy of a packet right after it
+	Duplicate float64
+	// Flips one bit of a packet's payload, recomputing its checksums if
+	// FixChecksums is set
+	Corrupt      float64
+	FixChecksums bool
+}
+
+type heldPacket struct {
+	packet Packet
+	// How many more packets have to overtake it before it leaves
+	left      int
+	overtaken int
+}
+
+// ImpairedEmulator reorders, duplicates and corrupts the packets that come
+// off another link. Each packet it affects is logged with its id, as a
+// packet_reordered, packet_duplicated or packet_corrupted event.
+type ImpairedEmulator struct {
+	clock                  Clock
+	rand                   *rand.Rand
+	link                   LinkEmulator
+	impairments            ImpairmentConfig
+	outgoingPacketCallback func(Packet)
+	held                   []heldPacket
+}
+
+func NewImpairedEmulator(clock Clock, rng *rand.Rand, link LinkEmulator, impairments ImpairmentConfig) *ImpairedEmulator {
+	e := &ImpairedEmulator{
+		clock:       clock,
+		rand:        rng,
+		link:        link,
+		impairments: impairments,
+	}
+	link.SetOnOutgoingPacket(e.onOutgoingPacket)
+	return e
+}
+
+func (e *ImpairedEmulator) onOutgoingPacket(p Packet) {
+	packets := []Packet{p}
+	if e.rand.Float64() < e.impairments.Corrupt {
+		e.corrupt(p)
+	}
+	if e.rand.Float64() < e.impairments.Duplicate {
+		e.log("packet_duplicated", p, nil)
+		packets = append(packets, p.Copy())
+	}
+	for _, p := range packets {
+		if e.impairments.ReorderWindow > 0 && e.rand.Float64() < e.impairments.Reorder {
+			e.held = append(e.held, heldPacket{packet: p, left: 1 + e.rand.Intn(e.impairments.ReorderWindow)})
+		} else {
+			e.send(p)
+		}
+	}
+	e.releaseIfIdle()
+}
+
+// Once nothing else is coming to overtake the packets held back, whether the
+// last packets on the link were delivered or dropped, they can't wait any
+// longer.
+func (e *ImpairedEmulator) releaseIfIdle() {
+	if e.link.Stats().Queued > 0 {
+		return
+	}
+	held := e.held
+	e.held = nil
+	for _, h := range held {
+		e.release(h)
+	}
+}
+
+// Sends p on, along with any packets it was the last to overtake.
+func (e *ImpairedEmulator) send(p Packet) {
+	e.outgoingPacketCallback(p)
+	var stillHeld []heldPacket
+	for _, held := range e.held {
+		held.left--
+		held.overtaken++
+		if held.left == 0 {
+			e.release(held)
+		} else {
+			stillHeld = append(stillHeld, held)
+		}
+	}
+	e.held = stillHeld
+}
+
+func (e *ImpairedEmulator) release(held heldPacket) {
+	if held.overtaken > 0 {
+		e.log("packet_reordered", held.packet, log.Fields{"displacement": held.overtaken})
+	}
+	e.outgoingPacketCallback(held.packet)
+}
+
+// Flips a random bit of p's payload. Packets without one are left alone.
+func (e *ImpairedEmulator) corrupt(p Packet) {
+	application := decodeIP(p.GetData()).ApplicationLayer()
+	if application == nil || len(application.Payload()) == 0 {
+		return
+	}
+	corruption := Corruption{
+		Bit:          e.rand.Intn(8 * len(application.Payload())),
+		FixChecksums: e.impairments.FixChecksums,
+	}
+	corruptions := p.GetCorruptions()
+	// Copies of p may share the corruptions' backing array
+	p.SetCorruptions(append(corruptions[:len(corruptions):len(corruptions)], corruption))
+	e.log("packet_corrupted", p, log.Fields{"bit": corruption.Bit, "fix_checksums": corruption.FixChecksums})
+}
+
+func (e *ImpairedEmulator) log(event string, p Packet, fields log.Fields) {
+	entry := log.WithFields(log.Fields{
+		"event": event,
+		"id":    p.GetId(),
+		"src":   e.link.SrcAddr(),
+		"dst":   e.link.DstAddr(),
+	})
+	if fields != nil {
+		entry = entry.WithFields(fields)
+	}
+	entry.WithTime(e.clock.Now()).Info()
+}
+
+func (e *ImpairedEmulator) WriteIncomingPacket(p Packet) {
+	e.link.WriteIncomingPacket(p)
+}
+
+func (e *ImpairedEmulator) SetOnIncomingPacket(callback func(Packet)) {
+	e.link.SetOnIncomingPacket(callback)
+}
+
+func (e *ImpairedEmulator) SetOnOutgoingPacket(callback func(Packet)) {
+	e.outgoingPacketCallback = callback
+}
+
+func (e *ImpairedEmulator) SetOnDroppedPacket(callback func(Packet, DropReason)) {
+	e.link.SetOnDroppedPacket(func(p Packet, reason DropReason) {
+		callback(p, reason)
+		e.releaseIfIdle()
+	})
+}
+
+func (e *ImpairedEmulator) SrcAddr() Address {
+	return e.link.SrcAddr()
+}
+
+func (e *ImpairedEmulator) DstAddr() Address {
+	return e.link.DstAddr()
+}
+
+func (e *ImpairedEmulator) Stats() LinkStats {
+	stats := e.link.Stats()
+	stats.Queued += len(e.held)
+	return stats
+}
@@ -0,0 +1,81 @@
+package simulation
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestImpairments(t *testing.T) {
+	epoch := time.Unix(0, 0)
+	clock := NewVirtualClock(epoch)
+	link := NewDelayEmulator(clock, NewDropTailQueue(100), 10*time.Millisecond, 0, 1)
+	emu := NewImpairedEmulator(clock, rand.New(rand.NewSource(1)), link, ImpairmentConfig{Reorder: 0.3, ReorderWindow: 3, Duplicate: 0.1, Corrupt: 0.1})
+	emu.SetOnIncomingPacket(func(Packet) {})
+	emu.SetOnDroppedPacket(func(Packet, DropReason) { t.Fatal("unexpected drop") })
+	var delivered []Packet
+	emu.SetOnOutgoingPacket(func(p Packet) { delivered = append(delivered, p) })
+	data := testUDPPacket(t, "100.64.0.4", 5000, "100.64.0.2", 5001)
+	for i := 0; i < 100; i++ {
+		arrival := epoch.Add(time.Duration(i) * time.Millisecond)
+		p := &DataPacket{Id: i, Data: data, ArrivalTime: arrival}
+		clock.At(arrival, func() { emu.WriteIncomingPacket(p) })
+	}
+	clock.RunUntilIdle()
+
+	copies := make(map[int]int)
+	reordered, corrupted := false, 0
+	for i, p := range delivered {
+		copies[p.GetId()]++
+		if i > 0 && p.GetId() < delivered[i-1].GetId() {
+			reordered = true
+		}
+		for _, corruption := range p.GetCorruptions() {
+			corrupted++
+			flipped := applyCorruptions(p.GetData(), []Corruption{corruption}, false)
+			// Only the 5 byte payload at the end may change
+			if !bytes.Equal(flipped[:len(flipped)-5], data[:len(data)-5]) || bytes.Equal(flipped, data) {
+				t.Fatalf("corruption %+v changed more than one payload bit", corruption)
+			}
+		}
+	}
+	if len(copies) != 100 || len(delivered) <= 100 || !reordered || corrupted == 0 {
+		t.Fatalf("expected every packet with some duplicated, reordered and corrupted, got %d packets of %d ids, reordered %v, %d corrupted", len(delivered), len(copies), reordered, corrupted)
+	}
+	if !bytes.Equal(data, testUDPPacket(t, "100.64.0.4", 5000, "100.64.0.2", 5001)) {
+		t.Fatal("corruption changed the packets' shared data")
+	}
+	if stats := emu.Stats(); stats.Queued != 0 {
+		t.Fatalf("expected nothing left on the link, got %d", stats.Queued)
+	}
+}
+
+func TestReorderedPacketsDrainPastLoss(t *testing.T) {
+	clock := NewVirtualClock(time.Unix(0, 0))
+	sink := NewChannelSink(100)
+	sim := NewSimulator(clock, 999, sink, net.ParseIP("10.0.0.2"))
+	loss := LossConfig{Type: "gilbert_elliott", P: 0.3, R: 0.3, BadLoss: 1}
+	delayLink := NewRandomDelayLinkConfig(ConstantDelay(10*time.Millisecond), false, loss, QueueConfig{}, 0, 999)
+	linkConfigs := []LinkConfig{NewImpairedLinkConfig(delayLink, ImpairmentConfig{Reorder: 0.9, ReorderWindow: 5})}
+	sim.SetRouter(NewBroadcastSimulator(ToNeighborsMap(linkConfigs)))
+	sim.Start(context.Background(), linkConfigs, 100)
+	for i := 0; i < 20; i++ {
+		sim.WriteNewPacket(&DataPacket{Id: i, Data: testUDPPacket(t, "100.64.0.4", 5000, "100.64.0.2", 5001)}, 0)
+	}
+	// Packets held back behind the last ones lost have to leave too, or
+	// Stop never finishes draining
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	sim.Stop(ctx)
+	sink.Close()
+	if ctx.Err() != nil {
+		t.Fatal("the link never drained")
+	}
+	stats := sim.forward.stats()[0]
+	if stats.Queued != 0 || stats.Delivered+stats.Dropped != 20 || stats.Dropped == 0 {
+		t.Fatalf("expected all 20 packets delivered or lost, got %+v", stats)
+	}
+}
@@ -1,9 +1,25 @@
 package simulation
 
-import "time"
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// LinkEnvironment holds the simulation-wide settings every link is built with.
+type LinkEnvironment struct {
+	Clock          Clock
+	MaxQueueLength int
+	// When the simulation started, which links that replay traces line them
+	// up against. Links use the time they are built at if it is zero.
+	Epoch time.Time
+	// Each link derives its own random number generator from Seed
+	Seed int64
+}
 
 type LinkConfig interface {
-	ToLinkEmulator(queueSize int) LinkEmulator
+	ToLinkEmulator(env LinkEnvironment) LinkEmulator
 	SrcAddr() Address
 	DstAddr() Address
 }
@@ -25,23 +41,37 @@ func ToNeighborsMap(configs []LinkConfig) NeighborMap {
 }
 
 type DelayLinkConfig struct {
-	delay time.Duration
-	src   Address
-	dst   Address
+	delay   DelayDistribution
+	reorder bool
+	loss    LossConfig
+	queue   QueueConfig
+	src     Address
+	dst     Address
+}
+
+func NewDelayLinkConfig(delay time.Duration, queue QueueConfig, src Address, dst Address) DelayLinkConfig {
+	return NewRandomDelayLinkConfig(ConstantDelay(delay), false, LossConfig{}, queue, src, dst)
 }
 
-func NewDelayLinkConfig(delay time.Duration, src Address, dst Address) DelayLinkConfig {
+// NewRandomDelayLinkConfig panics if queue is a CoDel queue, since packets
+// never wait on a delay link for CoDel to act on.
+func NewRandomDelayLinkConfig(delay DelayDistribution, reorder bool, loss LossConfig, queue QueueConfig, src Address, dst Address) DelayLinkConfig {
+	queue.checkNoWaiting("delay")
 	return DelayLinkConfig{
 		delay,
+		reorder,
+		loss,
+		queue,
 		src,
 		dst,
 	}
 }
 
-func (c DelayLinkConfig) ToLinkEmulator(queueSize int) LinkEmulator {
-	// TODO(aditi): make NewDelayEmulator return a pointer
-	newEmulator := NewDelayEmulator(queueSize, c.delay, c.src, c.dst)
-	return &newEmulator
+func (c DelayLinkConfig) ToLinkEmulator(env LinkEnvironment) LinkEmulator {
+	// The queue, the delays and loss share one stream
+	rng := NewLinkRand(env.Seed, c.src, c.dst)
+	queue := c.queue.ToQueue(env, rng)
+	return NewRandomDelayEmulator(env.Clock, rng, queue, c.delay, c.reorder, c.loss.ToLossModel(env.Clock, rng), c.src, c.dst)
 }
 
 func (c DelayLinkConfig) SrcAddr() Address {
@@ -52,26 +82,98 @@ func (c DelayLinkConfig) DstAddr() Address {
 	return c.dst
 }
 
+// DelayTraceLinkConfig is a delay link whose delays follow a recorded delay
+// trace, lined up against the simulation's epoch. It keeps packets in order
+// unless reorder is set, as delay links do.
+type DelayTraceLinkConfig struct {
+	filename    string
+	interpolate bool
+	reorder     bool
+	loss        LossConfig
+	queue       QueueConfig
+	src         Address
+	dst         Address
+}
+
+// NewDelayTraceLinkConfig panics if queue is a CoDel queue, as delay links do.
+func NewDelayTraceLinkConfig(filename string, interpolate bool, reorder bool, loss LossConfig, queue QueueConfig, src Address, dst Address) DelayTraceLinkConfig {
+	queue.checkNoWaiting("delay_trace")
+	return DelayTraceLinkConfig{
+		filename,
+		interpolate,
+		reorder,
+		loss,
+		queue,
+		src,
+		dst,
+	}
+}
+
+func (c DelayTraceLinkConfig) ToLinkEmulator(env LinkEnvironment) LinkEmulator {
+	rng := NewLinkRand(env.Seed, c.src, c.dst)
+	queue := c.queue.ToQueue(env, rng)
+	epoch := env.Epoch
+	if epoch.IsZero() {
+		epoch = env.Clock.Now()
+	}
+	delay := LoadDelayTrace(env.Clock, epoch, c.filename, c.interpolate)
+	return NewRandomDelayEmulator(env.Clock, rng, queue, delay, c.reorder, c.loss.ToLossModel(env.Clock, rng), c.src, c.dst)
+}
+
+func (c DelayTraceLinkConfig) SrcAddr() Address {
+	return c.src
+}
+
+func (c DelayTraceLinkConfig) DstAddr() Address {
+	return c.dst
+}
+
 type TraceLinkConfig struct {
-	filename     string
-	lossfilename string
-	src          Address
-	dst          Address
+	filename         string
+	opportunityBytes int
+	endPolicy        string
+	startOffset      time.Duration
+	randomOffset     bool
+	loss             LossConfig
+	queue            QueueConfig
+	src              Address
+	dst              Address
 }
 
-func NewTraceLinkConfig(filename string, lossfilename string, src Address, dst Address) TraceLinkConfig {
+// Each line of the trace without a byte count of its own delivers
+// opportunityBytes, or 1504 if it is 0. endPolicy is "loop", "stop" or
+// "hold", as for NewTraceEmulator. The link starts startOffset into the
+// trace, or at a point drawn from the seed if randomOffset is set.
+func NewTraceLinkConfig(filename string, opportunityBytes int, endPolicy string, startOffset time.Duration, randomOffset bool, loss LossConfig, queue QueueConfig, src Address, dst Address) TraceLinkConfig {
 	return TraceLinkConfig{
 		filename,
-		lossfilename,
+		opportunityBytes,
+		endPolicy,
+		startOffset,
+		randomOffset,
+		loss,
+		queue,
 		src,
 		dst,
 	}
 }
 
-func (c TraceLinkConfig) ToLinkEmulator(queueSize int) LinkEmulator {
-	// TODO(aditi): make NewTraceEmulator return a pointer too
-	newEmulator := NewTraceEmulator(c.filename, c.lossfilename, queueSize, c.src, c.dst)
-	return &newEmulator
+func (c TraceLinkConfig) ToLinkEmulator(env LinkEnvironment) LinkEmulator {
+	// Loss and the queue discipline draw from the same stream
+	rng := NewLinkRand(env.Seed, c.src, c.dst)
+	epoch := env.Epoch
+	if epoch.IsZero() {
+		epoch = env.Clock.Now()
+	}
+	sendOffsets, bytesPerOpportunity := readTrace(c.filename, c.opportunityBytes)
+	startOffset := c.startOffset
+	if c.randomOffset {
+		// Drawn separately so that it doesn't change the link's other draws
+		if period := sendOffsets[len(sendOffsets)-1]; period > 0 {
+			startOffset = time.Duration(newStageRand(env.Seed, c.src, c.dst, "start offset").Int63n(int64(period)))
+		}
+	}
+	return newTraceEmulator(env.Clock, epoch, startOffset, sendOffsets, bytesPerOpportunity, c.endPolicy, c.loss.ToLossModel(env.Clock, rng), c.queue.ToQueue(env, rng), c.src, c.dst)
 }
 
 func (c TraceLinkConfig) SrcAddr() Address {
@@ -81,3 +183,165 @@ func (c TraceLinkConfig) SrcAddr() Address {
 func (c TraceLinkConfig) DstAddr() Address {
 	return c.dst
 }
+
+type MobileLinkConfig struct {
+	mobility *Mobility
+	queue    QueueConfig
+	src      Address
+	dst      Address
+}
+
+func NewMobileLinkConfig(mobility *Mobility, queue QueueConfig, src Address, dst Address) MobileLinkConfig {
+	return MobileLinkConfig{
+		mobility,
+		queue,
+		src,
+		dst,
+	}
+}
+
+func (c MobileLinkConfig) ToLinkEmulator(env LinkEnvironment) LinkEmulator {
+	// Loss and the queue discipline draw from the same stream
+	rng := NewLinkRand(env.Seed, c.src, c.dst)
+	return NewMobileEmulator(env.Clock, rng, c.mobility, c.queue.ToQueue(env, rng), c.src, c.dst)
+}
+
+func (c MobileLinkConfig) SrcAddr() Address {
+	return c.src
+}
+
+func (c MobileLinkConfig) DstAddr() Address {
+	return c.dst
+}
+
+type RateLinkConfig struct {
+	rate  float64
+	burst int
+	delay time.Duration
+	queue QueueConfig
+	src   Address
+	dst   Address
+}
+
+// Rate is in bits per second and burst in bytes.
+func NewRateLinkConfig(rate float64, burst int, delay time.Duration, queue QueueConfig, src Address, dst Address) RateLinkConfig {
+	return RateLinkConfig{
+		rate,
+		burst,
+		delay,
+		queue,
+		src,
+		dst,
+	}
+}
+
+func (c RateLinkConfig) ToLinkEmulator(env LinkEnvironment) LinkEmulator {
+	queue := c.queue.ToQueue(env, NewLinkRand(env.Seed, c.src, c.dst))
+	return NewRateEmulator(env.Clock, queue, c.rate, c.burst, c.delay, c.src, c.dst)
+}
+
+func (c RateLinkConfig) SrcAddr() Address {
+	return c.src
+}
+
+func (c RateLinkConfig) DstAddr() Address {
+	return c.dst
+}
+
+// ImpairedLinkConfig is another link with impairments applied to the packets
+// that come off it.
+type ImpairedLinkConfig struct {
+	link        LinkConfig
+	impairments ImpairmentConfig
+}
+
+func NewImpairedLinkConfig(link LinkConfig, impairments ImpairmentConfig) ImpairedLinkConfig {
+	return ImpairedLinkConfig{
+		link,
+		impairments,
+	}
+}
+
+func (c ImpairedLinkConfig) ToLinkEmulator(env LinkEnvironment) LinkEmulator {
+	rng := newStageRand(env.Seed, c.link.SrcAddr(), c.link.DstAddr(), "impairments")
+	return NewImpairedEmulator(env.Clock, rng, c.link.ToLinkEmulator(env), c.impairments)
+}
+
+func (c ImpairedLinkConfig) SrcAddr() Address {
+	return c.link.SrcAddr()
+}
+
+func (c ImpairedLinkConfig) DstAddr() Address {
+	return c.link.DstAddr()
+}
+
+// Returns the link underneath any impairments applied to it.
+func baseLinkConfig(c LinkConfig) LinkConfig {
+	for {
+		impaired, ok := c.(ImpairedLinkConfig)
+		if !ok {
+			return c
+		}
+		c = impaired.link
+	}
+}
+
+// PipelineStage is one stage of a pipeline link. A stage with no Link applies
+// Impairments to the packets coming off every stage before it.
+type PipelineStage struct {
+	Name        string
+	Link        LinkConfig
+	Impairments ImpairmentConfig
+}
+
+// PipelineLinkConfig is a link made of stages, in the order packets go
+// through them. The first stage's queue is the link's ingress queue, and the
+// stages after it buffer without limit, so packets past the ingress are only
+// lost to the stages themselves. Their queues should be left as the default.
+type PipelineLinkConfig struct {
+	stages []PipelineStage
+	src    Address
+	dst    Address
+}
+
+func NewPipelineLinkConfig(stages []PipelineStage, src Address, dst Address) PipelineLinkConfig {
+	if len(stages) == 0 || stages[0].Link == nil {
+		panic("a pipeline link has to start with a stage that is a link")
+	}
+	return PipelineLinkConfig{
+		stages,
+		src,
+		dst,
+	}
+}
+
+func (c PipelineLinkConfig) ToLinkEmulator(env LinkEnvironment) LinkEmulator {
+	var emulators []LinkEmulator
+	var names []string
+	for i, stage := range c.stages {
+		// Every stage gets random numbers of its own
+		stageEnv := env
+		stageEnv.Seed = newStageRand(env.Seed, c.src, c.dst, fmt.Sprintf("stage %d", i)).Int63()
+		if i > 0 {
+			stageEnv.MaxQueueLength = math.MaxInt32
+		}
+		if stage.Link == nil {
+			before := NewPipelineEmulator(env.Clock, emulators, names, c.src, c.dst)
+			rng := rand.New(rand.NewSource(stageEnv.Seed))
+			emulators = []LinkEmulator{NewImpairedEmulator(env.Clock, rng, before, stage.Impairments)}
+			names = []string{stage.Name}
+			continue
+		}
+		emulators = append(emulators, stage.Link.ToLinkEmulator(stageEnv))
+		names = append(names, stage.Name)
+	}
+	return NewPipelineEmulator(env.Clock, emulators, names, c.src, c.dst)
+}
+
+func (c PipelineLinkConfig) SrcAddr() Address {
+	return c.src
+}
+
+func (c PipelineLinkConfig) DstAddr() Address {
+	return c.dst
+}
@@ -0,0 +1,69 @@
+package simulation
+
+// linkCounters keeps the counters every link emulator reports in LinkStats.
+type linkCounters struct {
+	enqueued  int
+	delivered int
+	bytesIn   int
+	bytesOut  int
+	drops     map[DropReason]int
+}
+
+func newLinkCounters() linkCounters {
+	return linkCounters{drops: make(map[DropReason]int)}
+}
+
+func (c *linkCounters) countIn(p Packet) {
+	c.enqueued++
+	c.bytesIn += len(p.GetData())
+}
+
+func (c *linkCounters) countOut(p Packet) {
+	c.delivered++
+	c.bytesOut += len(p.GetData())
+}
+
+func (c *linkCounters) countDrop(reason DropReason) {
+	c.drops[reason]++
+}
+
+// Fills in everything but the fields only some kinds of link have.
+func (c *linkCounters) stats(src Address, dst Address, queue QueueDiscipline) LinkStats {
+	queueStats := queue.Stats()
+	stats := LinkStats{
+		Src:           src,
+		Dst:           dst,
+		Enqueued:      c.enqueued,
+		Delivered:     c.delivered,
+		Queued:        queue.Len(),
+		QueueDrops:    queueStats.Drops,
+		QueueDelay:    queueStats.MeanDelay,
+		MaxQueueDelay: queueStats.MaxDelay,
+		BytesIn:       c.bytesIn,
+		BytesOut:      c.bytesOut,
+		Drops:         make(map[DropReason]int),
+	}
+	for reason, count := range c.drops {
+		stats.Dropped += count
+		stats.Drops[reason] = count
+	}
+	return stats
+}
+
+// Adds the counts of a link that was replaced by the one s describes. The
+// queue delays and trace offset stay those of the current link.
+func (s *LinkStats) addRetired(retired LinkStats) {
+	s.Enqueued += retired.Enqueued
+	s.Delivered += retired.Delivered
+	s.Dropped += retired.Dropped
+	s.Queued += retired.Queued
+	s.QueueDrops += retired.QueueDrops
+	s.BytesIn += retired.BytesIn
+	s.BytesOut += retired.BytesOut
+	if s.Drops == nil {
+		s.Drops = make(map[DropReason]int)
+	}
+	for reason, count := range retired.Drops {
+		s.Drops[reason] += count
+	}
+}
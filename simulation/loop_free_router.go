@@ -0,0 +1,32 @@
+package simulation
+
+// LoopFreeRouter wraps another router and refuses to send a packet to a node
+// it has already visited, so copies can't bounce between the same drones
+// until their hops run out.
+type LoopFreeRouter struct {
+	RoutingSimulator
+	refused int
+}
+
+func NewLoopFreeRouter(rs RoutingSimulator) *LoopFreeRouter {
+	return &LoopFreeRouter{RoutingSimulator: rs}
+}
+
+func (r *LoopFreeRouter) GetRoutedPackets(packet Packet, outgoingAddr Address) []Packet {
+	var packets []Packet
+	for _, routed := range r.RoutingSimulator.GetRoutedPackets(packet, outgoingAddr) {
+		if !hasVisited(routed, routed.GetDst()) {
+			packets = append(packets, routed)
+		} else {
+			r.refused++
+		}
+	}
+	return packets
+}
+
+// Stats leaves the copies that were refused out of the wrapped router's count.
+func (r *LoopFreeRouter) Stats() RouterStats {
+	stats := r.RoutingSimulator.Stats()
+	stats.Copies -= r.refused
+	return stats
+}
@@ -2,13 +2,121 @@ package simulation
 
 import (
 	"encoding/csv"
+	"fmt"
 	"io"
+	"math"
 	"math/rand"
 	"os"
 	"strconv"
 	"time"
 )
 
+// LossModel decides which packets a link loses on the wire.
+type LossModel interface {
+	// Drop returns whether the packet sent at now is lost.
+	Drop(now time.Time) bool
+	// Reason is what the packets it loses are dropped as.
+	Reason() DropReason
+}
+
+// LossConfig is how a link loses packets. Type is "" for no loss, "trace" to
+// replay the loss trace in File, "gilbert_elliott" or "markov".
+type LossConfig struct {
+	Type string
+	File string
+	// A Gilbert-Elliott model moves from its good state to its bad state
+	// after each packet with probability P, and back with probability R.
+	// BadLoss defaults to 1, which makes it a simple Gilbert model.
+	P        float64
+	R        float64
+	GoodLoss float64
+	BadLoss  float64
+	// A Markov model loses packets in state i with probability States[i],
+	// and moves from state i to j after each packet with probability
+	// Transitions[i][j]. It starts in state 0.
+	States      []float64
+	Transitions [][]float64
+}
+
+func (c LossConfig) ToLossModel(clock Clock, rng *rand.Rand) LossModel {
+	switch c.Type {
+	case "":
+		return noLoss{}
+	case "trace":
+		return NewLossEmulator(clock.Now(), c.File, rng)
+	case "gilbert_elliott":
+		badLoss := c.BadLoss
+		if badLoss == 0 {
+			badLoss = 1
+		}
+		return NewMarkovLoss(rng, []float64{c.GoodLoss, badLoss}, [][]float64{
+			{1 - c.P, c.P},
+			{c.R, 1 - c.R},
+		})
+	case "markov":
+		return NewMarkovLoss(rng, c.States, c.Transitions)
+	}
+	panic("unsupported loss model provided")
+}
+
+type noLoss struct{}
+
+func (noLoss) Drop(now time.Time) bool {
+	return false
+}
+
+func (noLoss) Reason() DropReason {
+	return DropModelLoss
+}
+
+// MarkovLoss loses packets in bursts, following a Markov chain that takes a
+// step after every packet. Each state has its own chance of loss.
+type MarkovLoss struct {
+	rand        *rand.Rand
+	states      []float64
+	transitions [][]float64
+	state       int
+}
+
+func NewMarkovLoss(rng *rand.Rand, states []float64, transitions [][]float64) *MarkovLoss {
+	if len(states) == 0 || len(transitions) != len(states) {
+		panic("a markov loss model needs a row of transitions for each of its states")
+	}
+	for i, row := range transitions {
+		if len(row) != len(states) {
+			panic(fmt.Sprintf("state %d of the markov loss model has %d transitions, expected %d", i, len(row), len(states)))
+		}
+		total := 0.0
+		for _, probability := range row {
+			total += probability
+		}
+		if math.Abs(total-1) > 1e-6 {
+			panic(fmt.Sprintf("transitions out of state %d of the markov loss model add up to %v", i, total))
+		}
+	}
+	return &MarkovLoss{rand: rng, states: states, transitions: transitions}
+}
+
+func (m *MarkovLoss) Drop(now time.Time) bool {
+	lost := m.rand.Float64() < m.states[m.state]
+	step := m.rand.Float64()
+	row := m.transitions[m.state]
+	next := len(row) - 1
+	for j, probability := range row {
+		if step < probability {
+			next = j
+			break
+		}
+		step -= probability
+	}
+	m.state = next
+	return lost
+}
+
+func (m *MarkovLoss) Reason() DropReason {
+	return DropModelLoss
+}
+
 type LossEntry struct {
 	offset      time.Duration
 	probability float64
@@ -18,13 +126,18 @@ type LossEmulator struct {
 	baseTime          time.Time
 	lossEntries       []LossEntry
 	currentEntryIndex int
+	rand              *rand.Rand
+	// Set when a trace link drives the loss trace, starting it over when its
+	// own trace does rather than looping on its own
+	following bool
 }
 
-func NewLossEmulator(baseTime time.Time, trace string) *LossEmulator {
+func NewLossEmulator(baseTime time.Time, trace string, rng *rand.Rand) *LossEmulator {
 	return &LossEmulator{
 		baseTime:          baseTime,
 		lossEntries:       loadLossTrace(trace),
 		currentEntryIndex: 0,
+		rand:              rng,
 	}
 }
 
@@ -52,13 +165,31 @@ func loadLossTrace(filename string) []LossEntry {
 	return lossEntries
 }
 
+// followTrace has the loss trace start at baseTime and keep its last
+// probability once it runs out, until restart is called.
+func (le *LossEmulator) followTrace(baseTime time.Time) {
+	le.following = true
+	le.restart(baseTime)
+}
+
+func (le *LossEmulator) restart(baseTime time.Time) {
+	le.baseTime = baseTime
+	le.currentEntryIndex = 0
+}
+
 func (le *LossEmulator) updateLossEntries(arrivalTime time.Time) {
+	if le.following && le.currentEntryIndex >= len(le.lossEntries)-2 {
+		return
+	}
 	nextEntryIndex, nextBase := le.nextEntry()
 	nextEntry := le.lossEntries[nextEntryIndex]
 	for arrivalTime.After(nextBase.Add(nextEntry.offset)) {
 		le.currentEntryIndex = nextEntryIndex
 		le.baseTime = nextBase
 
+		if le.following && le.currentEntryIndex >= len(le.lossEntries)-2 {
+			return
+		}
 		nextEntryIndex, nextBase = le.nextEntry()
 		nextEntry = le.lossEntries[nextEntryIndex]
 	}
@@ -79,6 +210,9 @@ func (le *LossEmulator) lossProbability() float64 {
 
 func (le *LossEmulator) Drop(arrivalTime time.Time) bool {
 	le.updateLossEntries(arrivalTime)
-	return rand.Float64() < le.lossProbability()
+	return le.rand.Float64() < le.lossProbability()
+}
 
+func (le *LossEmulator) Reason() DropReason {
+	return DropTraceLoss
 }
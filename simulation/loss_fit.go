@@ -0,0 +1,85 @@
+package simulation
+
+import (
+	"math"
+	"time"
+)
+
+// FitMarkovLoss estimates a Markov loss model from a delivery trace and the
+// loss trace that goes with it. Each delivery opportunity in the trace is
+// given the loss probability the loss trace has at that time, and the
+// opportunities are grouped into states by splitting the range of those
+// probabilities evenly. Each state loses packets at the mean probability of
+// its opportunities, and the transitions are counted between consecutive
+// opportunities, the last leading back to the first as the trace loops. So
+// the model takes a step per packet sent while the link is busy. Two states
+// are returned as a Gilbert-Elliott model.
+func FitMarkovLoss(traceFile string, lossFile string, states int) LossConfig {
+	if states < 1 {
+		panic("a loss model needs at least one state")
+	}
+	sendOffsets, _ := loadTrace(traceFile, defaultOpportunityBytes)
+	if len(sendOffsets) == 0 {
+		panic("no delivery opportunities to fit a loss model to")
+	}
+	lossTrace := NewLossEmulator(time.Time{}, lossFile, nil)
+	probabilities := make([]float64, len(sendOffsets))
+	low, high := math.Inf(1), math.Inf(-1)
+	for i, offset := range sendOffsets {
+		lossTrace.updateLossEntries(time.Time{}.Add(offset))
+		probabilities[i] = lossTrace.lossProbability()
+		low, high = math.Min(low, probabilities[i]), math.Max(high, probabilities[i])
+	}
+
+	// Bins no opportunity falls in don't become states
+	bins := make([]int, len(probabilities))
+	seen := make([]bool, states)
+	for i, probability := range probabilities {
+		if high > low {
+			bins[i] = int(math.Min(float64(states-1), (probability-low)/(high-low)*float64(states)))
+		}
+		seen[bins[i]] = true
+	}
+	binStates := make([]int, states)
+	used := 0
+	for bin := range seen {
+		if seen[bin] {
+			binStates[bin] = used
+			used++
+		}
+	}
+
+	config := LossConfig{
+		Type:        "markov",
+		States:      make([]float64, used),
+		Transitions: make([][]float64, used),
+	}
+	counts := make([]float64, used)
+	for i := range config.Transitions {
+		config.Transitions[i] = make([]float64, used)
+	}
+	for i, probability := range probabilities {
+		state := binStates[bins[i]]
+		next := binStates[bins[(i+1)%len(bins)]]
+		config.States[state] += probability
+		config.Transitions[state][next]++
+		counts[state]++
+	}
+	for state, count := range counts {
+		config.States[state] /= count
+		for next := range config.Transitions[state] {
+			config.Transitions[state][next] /= count
+		}
+	}
+
+	if used == 2 {
+		return LossConfig{
+			Type:     "gilbert_elliott",
+			P:        config.Transitions[0][1],
+			R:        config.Transitions[1][0],
+			GoodLoss: config.States[0],
+			BadLoss:  config.States[1],
+		}
+	}
+	return config
+}
@@ -0,0 +1,49 @@
+package simulation
+
+import (
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFitMarkovLoss(t *testing.T) {
+	dir, err := ioutil.TempDir("", "loss")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	trace := filepath.Join(dir, "link.pps")
+	loss := filepath.Join(dir, "link.loss")
+	if err := ioutil.WriteFile(trace, []byte("1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Opportunities 5 to 7 lose most packets, the rest none
+	if err := ioutil.WriteFile(loss, []byte("0,0\n4,0.8\n7,0\n10,0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fit := FitMarkovLoss(trace, loss, 2)
+	expected := LossConfig{Type: "gilbert_elliott", P: 1.0 / 7, R: 1.0 / 3, GoodLoss: 0, BadLoss: 0.8}
+	near := func(a, b float64) bool { return math.Abs(a-b) < 1e-6 }
+	if fit.Type != expected.Type || !near(fit.P, expected.P) || !near(fit.R, expected.R) ||
+		!near(fit.GoodLoss, expected.GoodLoss) || !near(fit.BadLoss, expected.BadLoss) {
+		t.Fatalf("expected %+v, got %+v", expected, fit)
+	}
+
+	// In the long run the model spends P/(P+R) of its steps in the bad state
+	model := fit.ToLossModel(NewVirtualClock(time.Unix(0, 0)), rand.New(rand.NewSource(1)))
+	lost := 0
+	for i := 0; i < 100000; i++ {
+		if model.Drop(time.Unix(0, 0)) {
+			lost++
+		}
+	}
+	rate := float64(lost) / 100000
+	if stationary := 0.8 * fit.P / (fit.P + fit.R); math.Abs(rate-stationary) > 0.01 {
+		t.Fatalf("expected a loss rate near %v, got %v", stationary, rate)
+	}
+}
@@ -0,0 +1,115 @@
+package simulation
+
+import (
+	"math/rand"
+)
+
+// MobileEmulator is a radio link between two moving nodes. It sends one
+// packet at a time at the link's capacity when the packet leaves the queue,
+// and the packet arrives once its signal has crossed the distance between
+// them. Packets are dropped if the nodes are out of range when they are sent,
+// and otherwise lost at random as the signal weakens.
+type MobileEmulator struct {
+	clock                  Clock
+	rand                   *rand.Rand
+	mobility               *Mobility
+	queue                  QueueDiscipline
+	src                    Address
+	dst                    Address
+	incomingPacketCallback func(Packet)
+	outgoingPacketCallback func(Packet)
+	droppedPacketCallback  func(Packet, DropReason)
+	counters               linkCounters
+	transmitting           bool
+	// Packets sent but not yet arrived
+	inFlight int
+}
+
+func NewMobileEmulator(clock Clock, rng *rand.Rand, mobility *Mobility, queue QueueDiscipline, src Address, dst Address) *MobileEmulator {
+	e := &MobileEmulator{
+		clock:    clock,
+		rand:     rng,
+		mobility: mobility,
+		queue:    queue,
+		src:      src,
+		dst:      dst,
+		counters: newLinkCounters(),
+	}
+	queue.SetOnDroppedPacket(e.drop)
+	return e
+}
+
+func (e *MobileEmulator) drop(p Packet, reason DropReason) {
+	e.counters.countDrop(reason)
+	e.droppedPacketCallback(p, reason)
+}
+
+func (e *MobileEmulator) SetOnIncomingPacket(callback func(Packet)) {
+	e.incomingPacketCallback = callback
+}
+
+func (e *MobileEmulator) SetOnOutgoingPacket(callback func(Packet)) {
+	e.outgoingPacketCallback = callback
+}
+
+func (e *MobileEmulator) SetOnDroppedPacket(callback func(Packet, DropReason)) {
+	e.droppedPacketCallback = callback
+}
+
+func (e *MobileEmulator) WriteIncomingPacket(p Packet) {
+	if !e.queue.Enqueue(p, e.clock.Now()) {
+		return
+	}
+	e.counters.countIn(p)
+	e.incomingPacketCallback(p)
+	if !e.transmitting {
+		e.transmitNext()
+	}
+}
+
+// Sends the packet at the head of the queue, if there is one.
+func (e *MobileEmulator) transmitNext() {
+	for {
+		now := e.clock.Now()
+		p := e.queue.Dequeue(now)
+		if p == nil {
+			e.transmitting = false
+			return
+		}
+		quality := e.mobility.Quality(e.src, e.dst, now)
+		if !quality.InRange {
+			e.drop(p, DropOutOfRange)
+			continue
+		}
+
+		e.transmitting = true
+		e.inFlight++
+		sent := now.Add(quality.TransmissionTime(len(p.GetData())))
+		lost := e.rand.Float64() < quality.LossProbability(len(p.GetData()))
+		e.clock.At(sent, e.transmitNext)
+		e.clock.At(sent.Add(quality.Delay), func() {
+			e.inFlight--
+			if lost {
+				e.drop(p, DropChannelLoss)
+				return
+			}
+			e.counters.countOut(p)
+			e.outgoingPacketCallback(p)
+		})
+		return
+	}
+}
+
+func (e *MobileEmulator) SrcAddr() Address {
+	return e.src
+}
+
+func (e *MobileEmulator) DstAddr() Address {
+	return e.dst
+}
+
+func (e *MobileEmulator) Stats() LinkStats {
+	stats := e.counters.stats(e.src, e.dst, e.queue)
+	stats.Queued += e.inFlight
+	return stats
+}
@@ -0,0 +1,264 @@
+package simulation
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const speedOfLight = 299792458.0 // m/s
+
+// Waypoint is where a node is at an offset into the run, in meters.
+type Waypoint struct {
+	Offset  time.Duration
+	X, Y, Z float64
+}
+
+// Trajectory is a node's path through the run. Between waypoints the node
+// moves in a straight line at constant speed, and it stays put before the
+// first waypoint and after the last.
+type Trajectory []Waypoint
+
+// LoadTrajectory reads a waypoint file, where each line is "offset_ms x y"
+// or "offset_ms x y z" with the position in meters. Lines must be in time
+// order.
+func LoadTrajectory(filename string) Trajectory {
+	file, err := os.Open(filename)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	var trajectory Trajectory
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		} else if len(fields) != 3 && len(fields) != 4 {
+			panic(fmt.Sprintf("bad waypoint %q in %s", scanner.Text(), filename))
+		}
+		var values [4]float64
+		for i, field := range fields {
+			if values[i], err = strconv.ParseFloat(field, 64); err != nil {
+				panic(err)
+			}
+		}
+		trajectory = append(trajectory, Waypoint{
+			Offset: time.Duration(values[0] * float64(time.Millisecond)),
+			X:      values[1],
+			Y:      values[2],
+			Z:      values[3],
+		})
+	}
+	if len(trajectory) == 0 {
+		panic(fmt.Sprintf("no waypoints in %s", filename))
+	}
+	return trajectory
+}
+
+// Position returns where the node is offset into the run.
+func (t Trajectory) Position(offset time.Duration) (float64, float64, float64) {
+	next := sort.Search(len(t), func(i int) bool { return t[i].Offset > offset })
+	if next == 0 {
+		return t[0].X, t[0].Y, t[0].Z
+	} else if next == len(t) {
+		last := t[len(t)-1]
+		return last.X, last.Y, last.Z
+	}
+	from, to := t[next-1], t[next]
+	fraction := float64(offset-from.Offset) / float64(to.Offset-from.Offset)
+	return from.X + fraction*(to.X-from.X),
+		from.Y + fraction*(to.Y-from.Y),
+		from.Z + fraction*(to.Z-from.Z)
+}
+
+// PropagationModel turns the distance between two nodes into the quality of
+// the link between them. Type is "free_space" or "log_distance". Powers are
+// in dBm, losses in dB, distances in meters, frequencies in Hz and rates in
+// bits per second. Fields left at 0 take the defaults in withDefaults.
+type PropagationModel struct {
+	Type      string
+	Frequency float64
+	// Log-distance path loss is ReferenceLoss at ReferenceDistance, growing
+	// by 10*Exponent dB for every tenfold increase in distance beyond it
+	ReferenceDistance float64
+	ReferenceLoss     float64
+	Exponent          float64
+	TxPower           float64
+	NoiseFloor        float64
+	Bandwidth         float64
+	// Caps the Shannon capacity, if set
+	MaxRate float64
+	// Nodes further apart than this have no link at all, if set
+	Range float64
+}
+
+func (m PropagationModel) withDefaults() PropagationModel {
+	if m.Type == "" {
+		m.Type = "free_space"
+	}
+	if m.Frequency == 0 {
+		m.Frequency = 2.4e9
+	}
+	if m.ReferenceDistance == 0 {
+		m.ReferenceDistance = 1
+	}
+	if m.ReferenceLoss == 0 {
+		m.ReferenceLoss = freeSpaceLoss(m.ReferenceDistance, m.Frequency)
+	}
+	if m.Exponent == 0 {
+		m.Exponent = 2
+	}
+	if m.TxPower == 0 {
+		m.TxPower = 20
+	}
+	if m.NoiseFloor == 0 {
+		m.NoiseFloor = -90
+	}
+	if m.Bandwidth == 0 {
+		m.Bandwidth = 20e6
+	}
+	if m.Type != "free_space" && m.Type != "log_distance" {
+		panic("unsupported propagation model provided")
+	}
+	return m
+}
+
+func freeSpaceLoss(distance float64, frequency float64) float64 {
+	return 20 * math.Log10(4*math.Pi*distance*frequency/speedOfLight)
+}
+
+// Returns the path loss over distance. Nodes closer together than the
+// reference distance lose as much as they would at it.
+func (m PropagationModel) pathLoss(distance float64) float64 {
+	distance = math.Max(distance, m.ReferenceDistance)
+	if m.Type == "free_space" {
+		return freeSpaceLoss(distance, m.Frequency)
+	}
+	return m.ReferenceLoss + 10*m.Exponent*math.Log10(distance/m.ReferenceDistance)
+}
+
+// LinkQuality is the state of a link between two nodes at one instant.
+type LinkQuality struct {
+	Distance float64
+	InRange  bool
+	// Time for a signal to cross the distance
+	Delay time.Duration
+	// Signal to noise ratio, in dB
+	SNR float64
+	// Bits per second
+	Capacity float64
+}
+
+func (m PropagationModel) quality(distance float64) LinkQuality {
+	snr := m.TxPower - m.pathLoss(distance) - m.NoiseFloor
+	capacity := m.Bandwidth * math.Log2(1+math.Pow(10, snr/10))
+	if m.MaxRate > 0 {
+		capacity = math.Min(capacity, m.MaxRate)
+	}
+	return LinkQuality{
+		Distance: distance,
+		InRange:  m.Range == 0 || distance <= m.Range,
+		Delay:    time.Duration(distance / speedOfLight * float64(time.Second)),
+		SNR:      snr,
+		Capacity: capacity,
+	}
+}
+
+// TransmissionTime returns how long a packet of size bytes takes to send.
+func (q LinkQuality) TransmissionTime(size int) time.Duration {
+	return time.Duration(float64(8*size) / q.Capacity * float64(time.Second))
+}
+
+// LossProbability returns the chance a packet of size bytes is corrupted,
+// taking each bit to be sent with uncoded BPSK at the link's SNR. Loss is
+// negligible until the SNR gets close to 10 dB and then climbs quickly.
+func (q LinkQuality) LossProbability(size int) float64 {
+	bitError := 0.5 * math.Erfc(math.Sqrt(math.Pow(10, q.SNR/10)))
+	return 1 - math.Pow(1-bitError, float64(8*size))
+}
+
+// Mobility moves nodes along their trajectories, timed from epoch, and works
+// out the quality of the links between them.
+type Mobility struct {
+	epoch        time.Time
+	trajectories map[Address]Trajectory
+	model        PropagationModel
+}
+
+func NewMobility(epoch time.Time, trajectories map[Address]Trajectory, model PropagationModel) *Mobility {
+	return &Mobility{epoch: epoch, trajectories: trajectories, model: model.withDefaults()}
+}
+
+// Quality returns the state of the link from src to dst at time t.
+func (m *Mobility) Quality(src Address, dst Address, t time.Time) LinkQuality {
+	srcTrajectory, ok := m.trajectories[src]
+	if !ok {
+		panic(fmt.Sprintf("no trajectory for node %d", src))
+	}
+	dstTrajectory, ok := m.trajectories[dst]
+	if !ok {
+		panic(fmt.Sprintf("no trajectory for node %d", dst))
+	}
+	x1, y1, z1 := srcTrajectory.Position(t.Sub(m.epoch))
+	x2, y2, z2 := dstTrajectory.Position(t.Sub(m.epoch))
+	return m.model.quality(math.Sqrt((x2-x1)*(x2-x1) + (y2-y1)*(y2-y1) + (z2-z1)*(z2-z1)))
+}
+
+// Track keeps neighbors up to date as nodes move, checking every interval
+// whether the ends of each mobile link in linkConfigs are in range of each
+// other. A link's destination is only a neighbor of its source while they are
+// in range, so routers that share neighbors never send packets over it
+// otherwise. Each change is logged as a neighbor_added or neighbor_removed
+// event. The checks are background callbacks, so on a virtual clock they only
+// carry on while something else is scheduled.
+func (m *Mobility) Track(clock Clock, neighbors NeighborMap, linkConfigs []LinkConfig, interval time.Duration) {
+	var links []LinkConfig
+	for _, linkConfig := range linkConfigs {
+		if mobile, ok := baseLinkConfig(linkConfig).(MobileLinkConfig); ok && mobile.mobility == m {
+			links = append(links, linkConfig)
+		}
+	}
+	var tick func()
+	tick = func() {
+		for _, link := range links {
+			src, dst := link.SrcAddr(), link.DstAddr()
+			quality := m.Quality(src, dst, clock.Now())
+			index := -1
+			for i, neighbor := range neighbors[src] {
+				if neighbor == dst {
+					index = i
+				}
+			}
+			event := ""
+			if quality.InRange && index == -1 {
+				neighbors[src] = append(neighbors[src], dst)
+				// Keep the order routers see neighbors in the same as when
+				// they were built from the topology
+				sort.Ints(neighbors[src])
+				event = "neighbor_added"
+			} else if !quality.InRange && index != -1 {
+				neighbors[src] = append(neighbors[src][:index:index], neighbors[src][index+1:]...)
+				event = "neighbor_removed"
+			}
+			if event != "" {
+				log.WithFields(log.Fields{
+					"event":    event,
+					"src":      src,
+					"dst":      dst,
+					"distance": quality.Distance,
+				}).WithTime(clock.Now()).Info()
+			}
+		}
+		clock.Background(clock.Now().Add(interval), tick)
+	}
+	clock.Background(clock.Now(), tick)
+}
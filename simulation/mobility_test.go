@@ -0,0 +1,65 @@
+package simulation
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMobileLinkFollowsDistance(t *testing.T) {
+	epoch := time.Unix(0, 0)
+	clock := NewVirtualClock(epoch)
+	sink := NewChannelSink(10)
+	sim := NewSimulator(clock, 999, sink, net.ParseIP("10.0.0.2"))
+
+	// Drone 1 flies from 100m to 2km away from drone 0 over a second, so it
+	// goes out of range just under halfway through
+	mobility := NewMobility(epoch, map[Address]Trajectory{
+		0: {{Offset: 0, X: 0}},
+		1: {{Offset: 0, X: 100}, {Offset: time.Second, X: 2000}},
+	}, PropagationModel{Range: 1000})
+	if x, _, _ := mobility.trajectories[1].Position(500 * time.Millisecond); x != 1050 {
+		t.Fatalf("expected drone 1 at 1050m halfway through, got %v", x)
+	}
+
+	linkConfigs := []LinkConfig{
+		NewMobileLinkConfig(mobility, QueueConfig{}, 0, 1),
+		NewDelayLinkConfig(10*time.Millisecond, QueueConfig{}, 0, 999),
+		NewDelayLinkConfig(2*time.Millisecond, QueueConfig{}, 1, 999),
+	}
+	neighbors := ToNeighborsMap(linkConfigs)
+	sim.SetRouter(NewBroadcastSimulator(neighbors))
+	mobility.Track(clock, neighbors, linkConfigs, 100*time.Millisecond)
+	for i, at := range []time.Duration{0, 900 * time.Millisecond} {
+		id := i
+		clock.At(epoch.Add(at), func() {
+			sim.WriteNewPacket(&DataPacket{Id: id, HopsLeft: 2, Data: testUDPPacket(t, "100.64.0.4", 5000, "100.64.0.2", 5001)}, 0)
+		})
+	}
+	sim.Start(context.Background(), linkConfigs, 10)
+	clock.At(epoch.Add(time.Second), func() {})
+	for clock.Now().Before(epoch.Add(time.Second)) {
+		time.Sleep(time.Millisecond)
+	}
+	sim.Stop(context.Background())
+	sink.Close()
+
+	var deliveries []time.Duration
+	for p := range sink.Packets() {
+		deliveries = append(deliveries, p.Time.Sub(epoch).Round(time.Millisecond))
+	}
+	// The first packet goes through drone 1 as well, the second can't
+	expected := []time.Duration{2 * time.Millisecond, 10 * time.Millisecond, 910 * time.Millisecond}
+	if len(deliveries) != len(expected) {
+		t.Fatalf("expected deliveries at %v, got %v", expected, deliveries)
+	}
+	for i := range expected {
+		if deliveries[i] != expected[i] {
+			t.Fatalf("expected deliveries at %v, got %v", expected, deliveries)
+		}
+	}
+	if len(neighbors[0]) != 1 || neighbors[0][0] != 999 {
+		t.Fatalf("expected drone 1 to have left drone 0's neighbors, got %v", neighbors[0])
+	}
+}
@@ -10,8 +10,20 @@ type Packet interface {
 	SetSrc(addr Address)
 	GetDst() Address
 	SetDst(addr Address)
+	// The node the packet entered the simulation at
+	GetOrigin() Address
+	SetOrigin(addr Address)
+	// The node the packet leaves the simulation from
+	GetTarget() Address
+	SetTarget(addr Address)
 	GetHopsLeft() int
 	SetHopsLeft(hops int)
+	// The links the packet has crossed so far, oldest first
+	GetPath() []Hop
+	SetPath(path []Hop)
+	// The bits links have flipped in the packet so far
+	GetCorruptions() []Corruption
+	SetCorruptions(corruptions []Corruption)
 	GetData() []byte
 	GetArrivalTime() time.Time
 	SetArrivalTime(t time.Time)
@@ -20,10 +32,67 @@ type Packet interface {
 	Copy() Packet
 }
 
+// Hop is one link a packet was sent over. Left is zero until the packet has
+// come off the link.
+type Hop struct {
+	Src     Address   `json:"src"`
+	Dst     Address   `json:"dst"`
+	Entered time.Time `json:"entered"`
+	Left    time.Time `json:"left"`
+}
+
+// Returns whether the packet started at node or has already been sent to it.
+func hasVisited(p Packet, node Address) bool {
+	if p.GetOrigin() == node {
+		return true
+	}
+	for _, hop := range p.GetPath() {
+		if hop.Dst == node {
+			return true
+		}
+	}
+	return false
+}
+
+// Corruption is a bit a link flipped in a packet's payload. Copies of a
+// packet share its data, so the bit is only flipped in what the simulator
+// writes out.
+type Corruption struct {
+	// Counted back from the end of the packet, so it stays in the payload
+	// however the headers in front of it are rewritten
+	Bit int `json:"bit"`
+	// Whether checksums are recomputed with the bit flipped, so the packet
+	// reaches the application, or left as they were, so the receiver
+	// discards it
+	FixChecksums bool `json:"fix_checksums"`
+}
+
+// Returns data with the corruptions that have FixChecksums set to
+// fixChecksums applied, copying it rather than changing it in place.
+func applyCorruptions(data []byte, corruptions []Corruption, fixChecksums bool) []byte {
+	copied := false
+	for _, corruption := range corruptions {
+		if corruption.FixChecksums != fixChecksums {
+			continue
+		}
+		if !copied {
+			data = append([]byte(nil), data...)
+			copied = true
+		}
+		index := len(data) - 1 - corruption.Bit/8
+		data[index] ^= 1 << uint(corruption.Bit%8)
+	}
+	return data
+}
+
 type DataPacket struct {
 	Src         Address
 	Dst         Address
+	Origin      Address
+	Target      Address
 	HopsLeft    int
+	Path        []Hop
+	Corruptions []Corruption
 	Data        []byte
 	ArrivalTime time.Time
 	Id          int
@@ -45,6 +114,22 @@ func (dp *DataPacket) SetDst(addr Address) {
 	dp.Dst = addr
 }
 
+func (dp *DataPacket) GetOrigin() Address {
+	return dp.Origin
+}
+
+func (dp *DataPacket) SetOrigin(addr Address) {
+	dp.Origin = addr
+}
+
+func (dp *DataPacket) GetTarget() Address {
+	return dp.Target
+}
+
+func (dp *DataPacket) SetTarget(addr Address) {
+	dp.Target = addr
+}
+
 func (dp *DataPacket) GetHopsLeft() int {
 	return dp.HopsLeft
 }
@@ -53,6 +138,22 @@ func (dp *DataPacket) SetHopsLeft(hops int) {
 	dp.HopsLeft = hops
 }
 
+func (dp *DataPacket) GetPath() []Hop {
+	return dp.Path
+}
+
+func (dp *DataPacket) SetPath(path []Hop) {
+	dp.Path = path
+}
+
+func (dp *DataPacket) GetCorruptions() []Corruption {
+	return dp.Corruptions
+}
+
+func (dp *DataPacket) SetCorruptions(corruptions []Corruption) {
+	dp.Corruptions = corruptions
+}
+
 func (dp *DataPacket) GetData() []byte {
 	return dp.Data
 }
@@ -76,25 +177,111 @@ func (dp *DataPacket) ClearData() {
 func (dp *DataPacket) Copy() Packet {
 	origPacket := *dp
 	newPacket := origPacket
+	// Copies go their own ways, so they can't share a path
+	newPacket.Path = make([]Hop, len(dp.Path))
+	copy(newPacket.Path, dp.Path)
+	newPacket.Corruptions = append([]Corruption(nil), dp.Corruptions...)
 	return &newPacket
 }
 
+// Links are driven entirely by the simulation clock. A packet written to a
+// link is handed to the outgoing callback once the link has finished with it.
 type LinkEmulator interface {
-	ApplyEmulation()
-	ReadOutgoingPacket() Packet
 	WriteIncomingPacket(Packet)
 	SetOnIncomingPacket(func(Packet))
+	SetOnOutgoingPacket(func(Packet))
+	SetOnDroppedPacket(func(Packet, DropReason))
 	SrcAddr() Address
 	DstAddr() Address
+	Stats() LinkStats
+}
+
+// DropReason says why a packet was dropped.
+type DropReason string
+
+const (
+	// The link's queue had no room for the packet
+	DropQueueFull DropReason = "queue_full"
+	// RED or CoDel dropped the packet before the queue filled up
+	DropQueueManagement DropReason = "queue_management"
+	DropTraceLoss       DropReason = "trace_loss"
+	// A Gilbert-Elliott or Markov loss model lost the packet
+	DropModelLoss DropReason = "model_loss"
+	// The packet used up its hops before reaching its target
+	DropHopLimit DropReason = "hop_limit"
+	// The router sent the packet nowhere, or over a link that doesn't exist
+	DropNoRoute DropReason = "no_route"
+	// The link was taken down mid-run
+	DropLinkDown DropReason = "link_down"
+	// The link's trace ran out and it was set to stop when it did
+	DropTraceEnded DropReason = "trace_ended"
+	// The ends of a mobile link were out of range of each other
+	DropOutOfRange DropReason = "out_of_range"
+	// A mobile link's signal was too weak to carry the packet intact
+	DropChannelLoss DropReason = "channel_loss"
+	// The packet couldn't be rewritten for the real network
+	DropUnsupportedProtocol DropReason = "unsupported_protocol"
+)
+
+// LinkStats counts what a link has done with the packets written to it.
+type LinkStats struct {
+	Src       Address `json:"src"`
+	Dst       Address `json:"dst"`
+	Enqueued  int     `json:"enqueued"`
+	Delivered int     `json:"delivered"`
+	Dropped   int     `json:"dropped"`
+	// Packets still on the link
+	Queued int `json:"queued"`
+	// Drops made by the link's queue discipline, which are included in Dropped
+	QueueDrops int `json:"queue_drops"`
+	// The mean and longest time packets waited in the queue
+	QueueDelay    time.Duration `json:"queue_delay"`
+	MaxQueueDelay time.Duration `json:"max_queue_delay"`
+	BytesIn       int           `json:"bytes_in"`
+	BytesOut      int           `json:"bytes_out"`
+	// Dropped broken down by reason
+	Drops map[DropReason]int `json:"drops"`
+	// How far into its trace a trace link is
+	TraceOffset time.Duration `json:"trace_offset"`
 }
 
 type OutgoingPacketResponse struct {
 	packetsToSend []Packet
 }
 
+// RouterStats counts the routing decisions a router has made.
+type RouterStats struct {
+	// Packets the router was asked to route
+	Routed int
+	// Packets it sent out, counting every copy
+	Copies int
+	// How many times each node sent a packet on to each of its neighbors,
+	// for routers that pick between them
+	Picks map[Address]map[Address]int
+}
+
+// Adds other's counts to s.
+func (s *RouterStats) add(other RouterStats) {
+	s.Routed += other.Routed
+	s.Copies += other.Copies
+	for src, picks := range other.Picks {
+		if s.Picks == nil {
+			s.Picks = make(map[Address]map[Address]int)
+		}
+		if s.Picks[src] == nil {
+			s.Picks[src] = make(map[Address]int)
+		}
+		for dst, count := range picks {
+			s.Picks[src][dst] += count
+		}
+	}
+}
+
 type RoutingSimulator interface {
+	Name() string
 	OnIncomingPacket(src Address, dst Address)
 	OnOutgoingPacket(p Packet)
 	OnLinkDequeue(p Packet)
 	GetRoutedPackets(packet Packet, outgoingAddr Address) []Packet
+	Stats() RouterStats
 }
@@ -0,0 +1,99 @@
+package simulation
+
+import (
+	"bufio"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+const pcapSnaplen = 65536
+
+// PcapSource yields the IP packets in a capture file along with the time
+// each one was captured.
+type PcapSource struct {
+	file   *os.File
+	reader *pcapgo.Reader
+	once   sync.Once
+}
+
+func NewPcapSource(filename string) *PcapSource {
+	file, err := os.Open(filename)
+	if err != nil {
+		panic(err)
+	}
+	reader, err := pcapgo.NewReader(bufio.NewReader(file))
+	if err != nil {
+		panic(err)
+	}
+	return &PcapSource{file: file, reader: reader}
+}
+
+// ReadPacket returns the next IP packet in the capture, stripped of any
+// link-layer header. It returns io.EOF once the capture is exhausted.
+func (r *PcapSource) ReadPacket() ([]byte, time.Time, error) {
+	for {
+		data, info, err := r.reader.ReadPacketData()
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		decoded := gopacket.NewPacket(data, r.reader.LinkType(), gopacket.NoCopy)
+		if networkLayer := decoded.NetworkLayer(); networkLayer != nil {
+			var packetData []byte
+			packetData = append(packetData, networkLayer.LayerContents()...)
+			packetData = append(packetData, networkLayer.LayerPayload()...)
+			return packetData, info.Timestamp, nil
+		}
+		// Skip frames without an IP packet in them (ARP and the like)
+	}
+}
+
+// Close is safe to call more than once.
+func (r *PcapSource) Close() error {
+	var err error
+	r.once.Do(func() {
+		err = r.file.Close()
+	})
+	return err
+}
+
+// PcapSink records raw IP packets to a capture file, stamped with the
+// simulation time at which they were delivered.
+type PcapSink struct {
+	file   *os.File
+	buffer *bufio.Writer
+	writer *pcapgo.Writer
+}
+
+func NewPcapSink(filename string) *PcapSink {
+	file, err := os.Create(filename)
+	if err != nil {
+		panic(err)
+	}
+	buffer := bufio.NewWriter(file)
+	writer := pcapgo.NewWriter(buffer)
+	if err := writer.WriteFileHeader(pcapSnaplen, layers.LinkTypeRaw); err != nil {
+		panic(err)
+	}
+	return &PcapSink{file: file, buffer: buffer, writer: writer}
+}
+
+func (w *PcapSink) WritePacket(data []byte, t time.Time) error {
+	info := gopacket.CaptureInfo{
+		Timestamp:     t,
+		CaptureLength: len(data),
+		Length:        len(data),
+	}
+	return w.writer.WritePacket(info, data)
+}
+
+func (w *PcapSink) Close() error {
+	if err := w.buffer.Flush(); err != nil {
+		return err
+	}
+	return w.file.Close()
+}
@@ -0,0 +1,108 @@
+package simulation
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// PipelineEmulator is a link made of stages that packets go through one after
+// another, each one a link of its own. Packets written to the pipeline go to
+// the first stage, and each stage hands what comes off it to the next. A
+// packet leaving a stage is logged as a packet_left_stage event with the
+// stage's name.
+type PipelineEmulator struct {
+	clock                  Clock
+	stages                 []LinkEmulator
+	names                  []string
+	src                    Address
+	dst                    Address
+	outgoingPacketCallback func(Packet)
+}
+
+func NewPipelineEmulator(clock Clock, stages []LinkEmulator, names []string, src Address, dst Address) *PipelineEmulator {
+	e := &PipelineEmulator{
+		clock:  clock,
+		stages: stages,
+		names:  names,
+		src:    src,
+		dst:    dst,
+	}
+	for i, stage := range stages {
+		i := i
+		stage.SetOnOutgoingPacket(func(p Packet) { e.onStageOutgoing(i, p) })
+		if i > 0 {
+			// Only the first stage's queue is the link's
+			stage.SetOnIncomingPacket(func(Packet) {})
+		}
+	}
+	return e
+}
+
+func (e *PipelineEmulator) onStageOutgoing(stage int, p Packet) {
+	log.WithFields(log.Fields{
+		"event": "packet_left_stage",
+		"id":    p.GetId(),
+		"src":   e.src,
+		"dst":   e.dst,
+		"stage": e.names[stage],
+	}).WithTime(e.clock.Now()).Info()
+	if stage == len(e.stages)-1 {
+		e.outgoingPacketCallback(p)
+		return
+	}
+	// Stages time packets from when they reach them
+	p.SetArrivalTime(e.clock.Now())
+	e.stages[stage+1].WriteIncomingPacket(p)
+}
+
+func (e *PipelineEmulator) WriteIncomingPacket(p Packet) {
+	e.stages[0].WriteIncomingPacket(p)
+}
+
+func (e *PipelineEmulator) SetOnIncomingPacket(callback func(Packet)) {
+	e.stages[0].SetOnIncomingPacket(callback)
+}
+
+func (e *PipelineEmulator) SetOnOutgoingPacket(callback func(Packet)) {
+	e.outgoingPacketCallback = callback
+}
+
+func (e *PipelineEmulator) SetOnDroppedPacket(callback func(Packet, DropReason)) {
+	for _, stage := range e.stages {
+		stage.SetOnDroppedPacket(callback)
+	}
+}
+
+func (e *PipelineEmulator) SrcAddr() Address {
+	return e.src
+}
+
+func (e *PipelineEmulator) DstAddr() Address {
+	return e.dst
+}
+
+// Packets come into the pipeline through the first stage's queue and leave it
+// from the last stage, and are on it or dropped anywhere in between.
+func (e *PipelineEmulator) Stats() LinkStats {
+	first := e.stages[0].Stats()
+	last := e.stages[len(e.stages)-1].Stats()
+	stats := first
+	stats.Src = e.src
+	stats.Dst = e.dst
+	stats.Delivered = last.Delivered
+	stats.BytesOut = last.BytesOut
+	stats.Queued = 0
+	stats.Dropped = 0
+	stats.Drops = make(map[DropReason]int)
+	for _, stage := range e.stages {
+		stageStats := stage.Stats()
+		stats.Queued += stageStats.Queued
+		for reason, count := range stageStats.Drops {
+			stats.Dropped += count
+			stats.Drops[reason] += count
+		}
+		if stats.TraceOffset == 0 {
+			stats.TraceOffset = stageStats.TraceOffset
+		}
+	}
+	return stats
+}
@@ -0,0 +1,44 @@
+package simulation
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPipelineStagesInOrder(t *testing.T) {
+	epoch := time.Unix(0, 0)
+	clock := NewVirtualClock(epoch)
+	// A 1000 byte per second link with room for one packet, then 40ms on
+	// the wire
+	config := NewPipelineLinkConfig([]PipelineStage{
+		{Name: "capacity", Link: NewRateLinkConfig(8000, 0, 0, QueueConfig{Limit: 1}, 0, 1)},
+		{Name: "core", Link: NewDelayLinkConfig(40*time.Millisecond, QueueConfig{}, 0, 1)},
+	}, 0, 1)
+	link := config.ToLinkEmulator(LinkEnvironment{Clock: clock, MaxQueueLength: 1, Seed: 1})
+	link.SetOnIncomingPacket(func(Packet) {})
+	var arrivals []time.Duration
+	link.SetOnOutgoingPacket(func(Packet) { arrivals = append(arrivals, clock.Now().Sub(epoch)) })
+	var drops []DropReason
+	link.SetOnDroppedPacket(func(p Packet, reason DropReason) { drops = append(drops, reason) })
+
+	clock.At(epoch, func() {
+		for i := 0; i < 3; i++ {
+			link.WriteIncomingPacket(&DataPacket{Id: i, ArrivalTime: epoch, Data: testUDPPacket(t, "100.64.0.4", 5000, "100.64.0.2", 5001)})
+		}
+	})
+	clock.RunUntilIdle()
+
+	// The first packet goes straight through, the second waits for it and
+	// the third finds the queue full
+	expected := []time.Duration{73 * time.Millisecond, 106 * time.Millisecond}
+	if len(arrivals) != len(expected) || arrivals[0] != expected[0] || arrivals[1] != expected[1] {
+		t.Fatalf("expected arrivals at %v, got %v", expected, arrivals)
+	}
+	if len(drops) != 1 || drops[0] != DropQueueFull {
+		t.Fatalf("expected one queue_full drop, got %v", drops)
+	}
+	stats := link.Stats()
+	if stats.Enqueued != 2 || stats.Delivered != 2 || stats.Dropped != 1 || stats.Queued != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
@@ -0,0 +1,365 @@
+package simulation
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// QueueDiscipline decides which of the packets waiting to go over a link are
+// kept, and in what order they leave.
+type QueueDiscipline interface {
+	// Enqueue adds p to the queue at time now. It returns false if the
+	// packet was dropped instead.
+	Enqueue(p Packet, now time.Time) bool
+	// Dequeue removes the next packet to send at time now, or returns nil if
+	// the queue is empty. Packets may be dropped on the way out.
+	Dequeue(now time.Time) Packet
+	Len() int
+	Bytes() int
+	Stats() QueueStats
+	// SetOnDroppedPacket sets the function called with every packet the
+	// queue drops, on the way in or out.
+	SetOnDroppedPacket(func(Packet, DropReason))
+}
+
+// QueueStats summarizes a queue's drops and how long packets waited in it.
+type QueueStats struct {
+	Drops     int
+	MeanDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+type queuedPacket struct {
+	packet   Packet
+	enqueued time.Time
+}
+
+// fifo is the buffer every discipline keeps its packets in, along with the
+// counters they all report.
+type fifo struct {
+	onDrop     func(Packet, DropReason)
+	packets    []queuedPacket
+	bytes      int
+	drops      int
+	dequeued   int
+	totalDelay time.Duration
+	maxDelay   time.Duration
+}
+
+func (q *fifo) push(p Packet, now time.Time) {
+	q.packets = append(q.packets, queuedPacket{packet: p, enqueued: now})
+	q.bytes += len(p.GetData())
+}
+
+// Returns the packet at the head of the queue and how long it was queued for.
+func (q *fifo) pop(now time.Time) (Packet, time.Duration) {
+	if len(q.packets) == 0 {
+		return nil, 0
+	}
+	head := q.packets[0]
+	q.packets[0] = queuedPacket{}
+	q.packets = q.packets[1:]
+	q.bytes -= len(head.packet.GetData())
+
+	sojourn := now.Sub(head.enqueued)
+	q.dequeued++
+	q.totalDelay += sojourn
+	if sojourn > q.maxDelay {
+		q.maxDelay = sojourn
+	}
+	return head.packet, sojourn
+}
+
+func (q *fifo) drop(p Packet, reason DropReason) {
+	q.drops++
+	if q.onDrop != nil {
+		q.onDrop(p, reason)
+	}
+}
+
+func (q *fifo) SetOnDroppedPacket(callback func(Packet, DropReason)) {
+	q.onDrop = callback
+}
+
+func (q *fifo) Len() int {
+	return len(q.packets)
+}
+
+func (q *fifo) Bytes() int {
+	return q.bytes
+}
+
+func (q *fifo) Stats() QueueStats {
+	stats := QueueStats{Drops: q.drops, MaxDelay: q.maxDelay}
+	if q.dequeued > 0 {
+		stats.MeanDelay = q.totalDelay / time.Duration(q.dequeued)
+	}
+	return stats
+}
+
+// DropTailQueue drops new packets once it holds limit packets.
+type DropTailQueue struct {
+	fifo
+	limit int
+}
+
+func NewDropTailQueue(limit int) *DropTailQueue {
+	return &DropTailQueue{limit: limit}
+}
+
+func (q *DropTailQueue) Enqueue(p Packet, now time.Time) bool {
+	if q.Len() >= q.limit {
+		q.drop(p, DropQueueFull)
+		return false
+	}
+	q.push(p, now)
+	return true
+}
+
+func (q *DropTailQueue) Dequeue(now time.Time) Packet {
+	p, _ := q.pop(now)
+	return p
+}
+
+// ByteQueue drops new packets that would take it over limit bytes.
+type ByteQueue struct {
+	fifo
+	limit int
+}
+
+func NewByteQueue(limit int) *ByteQueue {
+	return &ByteQueue{limit: limit}
+}
+
+func (q *ByteQueue) Enqueue(p Packet, now time.Time) bool {
+	if q.Bytes()+len(p.GetData()) > q.limit {
+		q.drop(p, DropQueueFull)
+		return false
+	}
+	q.push(p, now)
+	return true
+}
+
+func (q *ByteQueue) Dequeue(now time.Time) Packet {
+	p, _ := q.pop(now)
+	return p
+}
+
+// REDQueue is Random Early Detection (Floyd and Jacobson, 1993). Packets are
+// dropped with a probability that grows from 0 to maxProbability as the
+// average queue length goes from minThreshold to maxThreshold packets, and
+// always above that or once the queue holds limit packets.
+type REDQueue struct {
+	fifo
+	limit          int
+	minThreshold   float64
+	maxThreshold   float64
+	maxProbability float64
+	weight         float64
+	average        float64
+	// Packets accepted since the last drop, which spreads drops out evenly
+	count int
+	rand  *rand.Rand
+}
+
+func NewREDQueue(limit int, minThreshold float64, maxThreshold float64, maxProbability float64, weight float64, rng *rand.Rand) *REDQueue {
+	return &REDQueue{
+		limit:          limit,
+		minThreshold:   minThreshold,
+		maxThreshold:   maxThreshold,
+		maxProbability: maxProbability,
+		weight:         weight,
+		count:          -1,
+		rand:           rng,
+	}
+}
+
+func (q *REDQueue) Enqueue(p Packet, now time.Time) bool {
+	q.average = (1-q.weight)*q.average + q.weight*float64(q.Len())
+	if q.Len() >= q.limit {
+		q.drop(p, DropQueueFull)
+		return false
+	} else if q.shouldDrop() {
+		q.drop(p, DropQueueManagement)
+		return false
+	}
+	q.push(p, now)
+	return true
+}
+
+func (q *REDQueue) shouldDrop() bool {
+	if q.average < q.minThreshold {
+		q.count = -1
+		return false
+	} else if q.average >= q.maxThreshold {
+		q.count = 0
+		return true
+	}
+	q.count++
+	probability := q.maxProbability * (q.average - q.minThreshold) / (q.maxThreshold - q.minThreshold)
+	if scaled := 1 - float64(q.count)*probability; scaled > 0 {
+		probability = probability / scaled
+	} else {
+		probability = 1
+	}
+	if q.rand.Float64() < probability {
+		q.count = 0
+		return true
+	}
+	return false
+}
+
+func (q *REDQueue) Dequeue(now time.Time) Packet {
+	p, _ := q.pop(now)
+	return p
+}
+
+// Below this many bytes queued, CoDel never drops
+const codelMaxPacket = 1500
+
+// CoDelQueue is Controlled Delay (RFC 8289). Once packets have spent longer
+// than target in the queue for a whole interval, it drops packets on the way
+// out, more often the longer the delay persists.
+type CoDelQueue struct {
+	fifo
+	limit          int
+	target         time.Duration
+	interval       time.Duration
+	firstAboveTime time.Time
+	dropNext       time.Time
+	count          int
+	lastCount      int
+	dropping       bool
+}
+
+func NewCoDelQueue(limit int, target time.Duration, interval time.Duration) *CoDelQueue {
+	return &CoDelQueue{limit: limit, target: target, interval: interval}
+}
+
+func (q *CoDelQueue) Enqueue(p Packet, now time.Time) bool {
+	if q.Len() >= q.limit {
+		q.drop(p, DropQueueFull)
+		return false
+	}
+	q.push(p, now)
+	return true
+}
+
+func (q *CoDelQueue) controlLaw(t time.Time) time.Time {
+	return t.Add(time.Duration(float64(q.interval) / math.Sqrt(float64(q.count))))
+}
+
+// Pops the head of the queue and reports whether the delay has been above
+// target for long enough that it may be dropped.
+func (q *CoDelQueue) doDequeue(now time.Time) (Packet, bool) {
+	p, sojourn := q.pop(now)
+	if p == nil {
+		q.firstAboveTime = time.Time{}
+		return nil, false
+	}
+	if sojourn < q.target || q.Bytes() <= codelMaxPacket {
+		q.firstAboveTime = time.Time{}
+		return p, false
+	}
+	if q.firstAboveTime.IsZero() {
+		q.firstAboveTime = now.Add(q.interval)
+		return p, false
+	}
+	return p, !now.Before(q.firstAboveTime)
+}
+
+func (q *CoDelQueue) Dequeue(now time.Time) Packet {
+	p, okToDrop := q.doDequeue(now)
+	if p == nil {
+		q.dropping = false
+		return nil
+	}
+	if q.dropping {
+		if !okToDrop {
+			q.dropping = false
+		}
+		for q.dropping && !now.Before(q.dropNext) {
+			q.drop(p, DropQueueManagement)
+			q.count++
+			p, okToDrop = q.doDequeue(now)
+			if !okToDrop {
+				q.dropping = false
+			} else {
+				q.dropNext = q.controlLaw(q.dropNext)
+			}
+		}
+	} else if okToDrop {
+		q.drop(p, DropQueueManagement)
+		p, _ = q.doDequeue(now)
+		q.dropping = true
+		// Pick up close to the old drop rate if the last dropping state
+		// ended recently
+		delta := q.count - q.lastCount
+		if delta > 1 && now.Sub(q.dropNext) < 16*q.interval {
+			q.count = delta
+		} else {
+			q.count = 1
+		}
+		q.dropNext = q.controlLaw(now)
+		q.lastCount = q.count
+	}
+	return p
+}
+
+// QueueConfig selects the queue discipline a link buffers packets with.
+// Type is "droptail" (the default), "bytes", "red" or "codel". Limit is in
+// bytes for "bytes", which must set it, and in packets otherwise, where 0
+// uses the simulation's MaxQueueLength. Thresholds are in packets.
+type QueueConfig struct {
+	Type           string
+	Limit          int
+	MinThreshold   float64
+	MaxThreshold   float64
+	MaxProbability float64
+	Weight         float64
+	Target         time.Duration
+	Interval       time.Duration
+}
+
+// Rejects disciplines that go by how long packets have waited, for links
+// where packets are only ever in flight and never wait.
+func (c QueueConfig) checkNoWaiting(linkType string) {
+	if c.Type == "codel" {
+		panic(fmt.Sprintf("%s links can't have codel queues, as packets never wait on them", linkType))
+	}
+}
+
+func (c QueueConfig) ToQueue(env LinkEnvironment, rng *rand.Rand) QueueDiscipline {
+	limit := c.Limit
+	if limit == 0 {
+		limit = env.MaxQueueLength
+	}
+	switch c.Type {
+	case "", "droptail":
+		return NewDropTailQueue(limit)
+	case "bytes":
+		if c.Limit == 0 {
+			panic("byte queues need a limit")
+		}
+		return NewByteQueue(c.Limit)
+	case "red":
+		weight := c.Weight
+		if weight == 0 {
+			weight = 0.002
+		}
+		return NewREDQueue(limit, c.MinThreshold, c.MaxThreshold, c.MaxProbability, weight, rng)
+	case "codel":
+		target, interval := c.Target, c.Interval
+		if target == 0 {
+			target = 5 * time.Millisecond
+		}
+		if interval == 0 {
+			interval = 100 * time.Millisecond
+		}
+		return NewCoDelQueue(limit, target, interval)
+	default:
+		panic("unsupported queue type provided")
+	}
+}
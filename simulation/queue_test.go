@@ -0,0 +1,55 @@
+package simulation
+
+import (
+	"testing"
+	"time"
+)
+
+func TestByteQueueLimitsBytes(t *testing.T) {
+	queue := NewByteQueue(100)
+	var reasons []DropReason
+	queue.SetOnDroppedPacket(func(p Packet, reason DropReason) { reasons = append(reasons, reason) })
+	now := time.Unix(0, 0)
+	if !queue.Enqueue(&DataPacket{Data: make([]byte, 60)}, now) {
+		t.Fatal("packet under the limit was dropped")
+	}
+	if queue.Enqueue(&DataPacket{Data: make([]byte, 60)}, now) {
+		t.Fatal("packet over the limit was queued")
+	}
+	if len(reasons) != 1 || reasons[0] != DropQueueFull {
+		t.Fatalf("unexpected drop reasons %v", reasons)
+	}
+	queue.Dequeue(now.Add(30 * time.Millisecond))
+	stats := queue.Stats()
+	if stats.Drops != 1 || stats.MeanDelay != 30*time.Millisecond || queue.Bytes() != 0 {
+		t.Fatalf("unexpected stats %+v with %d bytes queued", stats, queue.Bytes())
+	}
+}
+
+func TestCoDelDropsOnlyPersistentDelay(t *testing.T) {
+	epoch := time.Unix(0, 0)
+	queue := NewCoDelQueue(100, 5*time.Millisecond, 100*time.Millisecond)
+	for i := 0; i < 50; i++ {
+		queue.Enqueue(&DataPacket{Id: i, Data: make([]byte, 1000)}, epoch)
+	}
+
+	// Drain the standing queue slowly, so every packet waits well over target
+	for now := epoch; queue.Len() > 0; now = now.Add(10 * time.Millisecond) {
+		queue.Dequeue(now)
+		if now.Sub(epoch) < 100*time.Millisecond && queue.Stats().Drops > 0 {
+			t.Fatalf("dropped at %v, before the delay had lasted an interval", now.Sub(epoch))
+		}
+	}
+	if queue.Stats().Drops == 0 {
+		t.Fatal("a persistent queue was never dropped from")
+	}
+}
+
+func TestDelayLinksRejectCoDel(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected a delay link with a codel queue to be rejected")
+		}
+	}()
+	NewDelayLinkConfig(time.Millisecond, QueueConfig{Type: "codel"}, 0, 1)
+}
@@ -0,0 +1,26 @@
+package simulation
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math/rand"
+)
+
+// NewLinkRand returns the random number generator for the link from src to
+// dst. Every link gets its own stream derived from the simulation seed, so a
+// link's random decisions don't depend on what happens on any other link.
+func NewLinkRand(seed int64, src Address, dst Address) *rand.Rand {
+	h := fnv.New64a()
+	binary.Write(h, binary.LittleEndian, []int64{seed, int64(src), int64(dst)})
+	return rand.New(rand.NewSource(int64(h.Sum64())))
+}
+
+// Returns the random number generator for one stage of the link from src to
+// dst, such as its impairments, which draws independently of the link itself
+// and of its other stages.
+func newStageRand(seed int64, src Address, dst Address, stage string) *rand.Rand {
+	h := fnv.New64a()
+	binary.Write(h, binary.LittleEndian, []int64{seed, int64(src), int64(dst)})
+	h.Write([]byte(stage))
+	return rand.New(rand.NewSource(int64(h.Sum64())))
+}
@@ -0,0 +1,141 @@
+package simulation
+
+import (
+	"math"
+	"time"
+)
+
+// RateEmulator is a link with limited capacity. Each packet takes its size
+// over rate bits per second to serialize, one after another, and then delay
+// to arrive. While the link is idle it saves up its unused capacity, to at
+// most burst bytes, and packets that fit in what it has saved leave at once
+// instead of serializing. So after the link has been idle a burst of up to
+// burst bytes goes out back to back, and everything after it is paced at
+// rate.
+type RateEmulator struct {
+	clock                  Clock
+	queue                  QueueDiscipline
+	rate                   float64
+	burst                  int
+	delay                  time.Duration
+	src                    Address
+	dst                    Address
+	incomingPacketCallback func(Packet)
+	outgoingPacketCallback func(Packet)
+	droppedPacketCallback  func(Packet, DropReason)
+	counters               linkCounters
+	// Bytes that can leave without serializing, as of lastFill
+	tokens   float64
+	lastFill time.Time
+	// When the packet being serialized has finished
+	busyUntil time.Time
+	// Whether a wakeup is scheduled for when the link is free
+	waiting  bool
+	inFlight int
+}
+
+func NewRateEmulator(clock Clock, queue QueueDiscipline, rate float64, burst int, delay time.Duration, src Address, dst Address) *RateEmulator {
+	e := &RateEmulator{
+		clock:    clock,
+		queue:    queue,
+		rate:     rate,
+		burst:    burst,
+		delay:    delay,
+		src:      src,
+		dst:      dst,
+		counters: newLinkCounters(),
+		tokens:   float64(burst),
+		lastFill: clock.Now(),
+	}
+	queue.SetOnDroppedPacket(func(p Packet, reason DropReason) {
+		e.counters.countDrop(reason)
+		e.droppedPacketCallback(p, reason)
+	})
+	return e
+}
+
+func (e *RateEmulator) SetOnIncomingPacket(callback func(Packet)) {
+	e.incomingPacketCallback = callback
+}
+
+func (e *RateEmulator) SetOnOutgoingPacket(callback func(Packet)) {
+	e.outgoingPacketCallback = callback
+}
+
+func (e *RateEmulator) SetOnDroppedPacket(callback func(Packet, DropReason)) {
+	e.droppedPacketCallback = callback
+}
+
+func (e *RateEmulator) WriteIncomingPacket(p Packet) {
+	if !e.queue.Enqueue(p, e.clock.Now()) {
+		return
+	}
+	e.counters.countIn(p)
+	e.incomingPacketCallback(p)
+	if !e.waiting {
+		e.send()
+	}
+}
+
+// Sends packets until the queue is empty or one is being serialized, then
+// waits for the link to be free again.
+func (e *RateEmulator) send() {
+	for {
+		now := e.clock.Now()
+		if now.Before(e.busyUntil) {
+			e.waiting = true
+			e.clock.At(e.busyUntil, func() {
+				e.waiting = false
+				e.send()
+			})
+			return
+		}
+		p := e.queue.Dequeue(now)
+		if p == nil {
+			return
+		}
+		e.fill(now)
+
+		leaves := now
+		size := float64(len(p.GetData()))
+		// Allow for rounding in the time the link was idle for
+		if e.tokens+1e-6 >= size {
+			e.tokens = math.Max(0, e.tokens-size)
+		} else {
+			e.busyUntil = now.Add(time.Duration(math.Ceil(size * 8 / e.rate * float64(time.Second))))
+			leaves = e.busyUntil
+		}
+		e.inFlight++
+		e.clock.At(leaves.Add(e.delay), func() {
+			e.inFlight--
+			e.counters.countOut(p)
+			e.outgoingPacketCallback(p)
+		})
+	}
+}
+
+// Adds the capacity the link has left unused since tokens were last counted.
+func (e *RateEmulator) fill(now time.Time) {
+	idleSince := e.lastFill
+	if e.busyUntil.After(idleSince) {
+		idleSince = e.busyUntil
+	}
+	if now.After(idleSince) {
+		e.tokens = math.Min(float64(e.burst), e.tokens+now.Sub(idleSince).Seconds()*e.rate/8)
+	}
+	e.lastFill = now
+}
+
+func (e *RateEmulator) SrcAddr() Address {
+	return e.src
+}
+
+func (e *RateEmulator) DstAddr() Address {
+	return e.dst
+}
+
+func (e *RateEmulator) Stats() LinkStats {
+	stats := e.counters.stats(e.src, e.dst, e.queue)
+	stats.Queued += e.inFlight
+	return stats
+}
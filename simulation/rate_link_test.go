@@ -0,0 +1,66 @@
+package simulation
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLinkPacesAfterBurst(t *testing.T) {
+	epoch := time.Unix(0, 0)
+	clock := NewVirtualClock(epoch)
+	// 1000 bytes per second, with room for two 33 byte packets at once
+	link := NewRateEmulator(clock, NewDropTailQueue(10), 8000, 66, time.Millisecond, 0, 1)
+	var arrivals []time.Duration
+	link.SetOnIncomingPacket(func(Packet) {})
+	link.SetOnOutgoingPacket(func(Packet) { arrivals = append(arrivals, clock.Now().Sub(epoch)) })
+	link.SetOnDroppedPacket(func(Packet, DropReason) { t.Fatal("unexpected drop") })
+
+	for i := 0; i < 4; i++ {
+		link.WriteIncomingPacket(&DataPacket{Id: i, Data: testUDPPacket(t, "100.64.0.4", 5000, "100.64.0.2", 5001)})
+	}
+	clock.RunUntilIdle()
+
+	expected := []time.Duration{1 * time.Millisecond, 1 * time.Millisecond, 34 * time.Millisecond, 67 * time.Millisecond}
+	if len(arrivals) != len(expected) {
+		t.Fatalf("expected arrivals at %v, got %v", expected, arrivals)
+	}
+	for i := range expected {
+		if arrivals[i] != expected[i] {
+			t.Fatalf("expected arrivals at %v, got %v", expected, arrivals)
+		}
+	}
+}
+
+func TestRateLinkSerializesAfterIdle(t *testing.T) {
+	// 1000 bytes per second, so a 33 byte packet takes 33ms to serialize
+	// unless the link has saved up room for it
+	for burst, expected := range map[int][]time.Duration{
+		0:  {1033 * time.Millisecond, 1066 * time.Millisecond},
+		33: {1000 * time.Millisecond, 1033 * time.Millisecond},
+	} {
+		epoch := time.Unix(0, 0)
+		clock := NewVirtualClock(epoch)
+		link := NewRateEmulator(clock, NewDropTailQueue(10), 8000, burst, 0, 0, 1)
+		var arrivals []time.Duration
+		link.SetOnIncomingPacket(func(Packet) {})
+		link.SetOnOutgoingPacket(func(Packet) { arrivals = append(arrivals, clock.Now().Sub(epoch)) })
+		link.SetOnDroppedPacket(func(Packet, DropReason) { t.Fatal("unexpected drop") })
+
+		// The link sits idle for a second first
+		clock.At(epoch.Add(time.Second), func() {
+			for i := 0; i < 2; i++ {
+				link.WriteIncomingPacket(&DataPacket{Id: i, Data: testUDPPacket(t, "100.64.0.4", 5000, "100.64.0.2", 5001)})
+			}
+		})
+		clock.RunUntilIdle()
+
+		if len(arrivals) != len(expected) {
+			t.Fatalf("burst %d: expected arrivals at %v, got %v", burst, expected, arrivals)
+		}
+		for i := range expected {
+			if arrivals[i] != expected[i] {
+				t.Fatalf("burst %d: expected arrivals at %v, got %v", burst, expected, arrivals)
+			}
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package simulation
+
+import (
+	"errors"
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var errNotIP = errors.New("not an IPv4 or IPv6 packet")
+
+// ipHeader returns the addresses and protocol of an IPv4 or IPv6 packet.
+func ipHeader(decodedPacket gopacket.Packet) (net.IP, net.IP, layers.IPProtocol, bool) {
+	switch ip := decodedPacket.NetworkLayer().(type) {
+	case *layers.IPv4:
+		return ip.SrcIP, ip.DstIP, ip.Protocol, true
+	case *layers.IPv6:
+		if ip.HopByHop != nil {
+			return ip.SrcIP, ip.DstIP, ip.HopByHop.NextHeader, true
+		}
+		return ip.SrcIP, ip.DstIP, ip.NextHeader, true
+	default:
+		return nil, nil, 0, false
+	}
+}
+
+// Returns addr in the form used by the IP version of the packet, or an error
+// if it is an address of the other version.
+func addressFor(decodedPacket gopacket.Packet, addr net.IP) (net.IP, error) {
+	if _, ok := decodedPacket.NetworkLayer().(*layers.IPv4); ok {
+		if v4 := addr.To4(); v4 != nil {
+			return v4, nil
+		}
+		return nil, errors.New("no IPv4 address to rewrite to")
+	}
+	if addr.To4() == nil && addr.To16() != nil {
+		return addr.To16(), nil
+	}
+	return nil, errors.New("no IPv6 address to rewrite to")
+}
+
+// rewriteAddresses reserializes an IPv4 or IPv6 packet with its source and
+// destination replaced by src and dst. A nil address is left as it is.
+// Checksums are recomputed for UDP, TCP, ICMP and ICMPv6, and any other
+// payload is copied unchanged. Fragments are copied unchanged too, since a
+// transport checksum can't be recomputed from part of the datagram.
+func rewriteAddresses(decodedPacket gopacket.Packet, src net.IP, dst net.IP) ([]byte, error) {
+	networkLayer := decodedPacket.NetworkLayer()
+	if _, _, _, ok := ipHeader(decodedPacket); !ok {
+		return nil, errNotIP
+	}
+	var err error
+	if src != nil {
+		if src, err = addressFor(decodedPacket, src); err != nil {
+			return nil, err
+		}
+	}
+	if dst != nil {
+		if dst, err = addressFor(decodedPacket, dst); err != nil {
+			return nil, err
+		}
+	}
+
+	var network gopacket.SerializableLayer
+	switch ip := networkLayer.(type) {
+	case *layers.IPv4:
+		if src != nil {
+			ip.SrcIP = src
+		}
+		if dst != nil {
+			ip.DstIP = dst
+		}
+		network = ip
+	case *layers.IPv6:
+		if src != nil {
+			ip.SrcIP = src
+		}
+		if dst != nil {
+			ip.DstIP = dst
+		}
+		network = ip
+	}
+
+	toSerialize := []gopacket.SerializableLayer{network}
+	switch transport := layerAfterIP(decodedPacket).(type) {
+	case *layers.UDP:
+		transport.SetNetworkLayerForChecksum(networkLayer)
+		toSerialize = append(toSerialize, transport, gopacket.Payload(transport.LayerPayload()))
+	case *layers.TCP:
+		transport.SetNetworkLayerForChecksum(networkLayer)
+		toSerialize = append(toSerialize, transport, gopacket.Payload(transport.LayerPayload()))
+	case *layers.ICMPv4:
+		toSerialize = append(toSerialize, transport, gopacket.Payload(transport.LayerPayload()))
+	case *layers.ICMPv6:
+		transport.SetNetworkLayerForChecksum(networkLayer)
+		toSerialize = append(toSerialize, transport, gopacket.Payload(transport.LayerPayload()))
+	default:
+		toSerialize = append(toSerialize, gopacket.Payload(networkLayer.LayerPayload()))
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{ComputeChecksums: true}, toSerialize...); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Returns the layer carried directly by the IP header, which is a fragment,
+// an extension header or a decoding failure rather than a transport layer
+// whenever the packet can't be rewritten layer by layer.
+func layerAfterIP(decodedPacket gopacket.Packet) gopacket.Layer {
+	packetLayers := decodedPacket.Layers()
+	for i, layer := range packetLayers {
+		if layer != decodedPacket.NetworkLayer() {
+			continue
+		}
+		// The IPv6 layer serializes its own hop-by-hop options
+		if i+1 < len(packetLayers) && packetLayers[i+1].LayerType() == layers.LayerTypeIPv6HopByHop {
+			i++
+		}
+		if i+1 < len(packetLayers) {
+			return packetLayers[i+1]
+		}
+		return nil
+	}
+	return nil
+}
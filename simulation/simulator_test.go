@@ -0,0 +1,367 @@
+package simulation
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func testUDPPacket(t *testing.T, src string, srcPort int, dst string, dstPort int) []byte {
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.ParseIP(src),
+		DstIP:    net.ParseIP(dst),
+	}
+	udp := &layers.UDP{SrcPort: layers.UDPPort(srcPort), DstPort: layers.UDPPort(dstPort)}
+	udp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(
+		buf,
+		gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true},
+		ip,
+		udp,
+		gopacket.Payload([]byte("hello")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestSimulatorDeliversToChannelSink(t *testing.T) {
+	epoch := time.Unix(0, 0)
+	clock := NewVirtualClock(epoch)
+	sink := NewChannelSink(10)
+	sim := NewSimulator(clock, 999, sink, net.ParseIP("10.0.0.2"))
+	linkConfigs := []LinkConfig{
+		NewDelayLinkConfig(time.Millisecond, QueueConfig{}, 0, 1),
+		NewDelayLinkConfig(10*time.Millisecond, QueueConfig{}, 0, 999),
+		NewDelayLinkConfig(2*time.Millisecond, QueueConfig{}, 1, 999),
+	}
+	sim.SetRouter(NewBestNeighborSimulator(clock, ToNeighborsMap(linkConfigs), 999, 0))
+	sim.Start(context.Background(), linkConfigs, 10)
+
+	sim.WriteNewPacket(&DataPacket{Src: 0, HopsLeft: 2, Data: testUDPPacket(t, "100.64.0.4", 5000, "100.64.0.2", 5001)}, 0)
+	sim.Stop(context.Background())
+	sink.Close()
+
+	var deliveries []time.Duration
+	for p := range sink.Packets() {
+		deliveries = append(deliveries, p.Time.Sub(epoch))
+	}
+	if len(deliveries) != 2 {
+		t.Fatalf("expected 2 deliveries, got %v", deliveries)
+	}
+	if deliveries[0] != 3*time.Millisecond || deliveries[1] != 10*time.Millisecond {
+		t.Fatalf("unexpected delivery times %v", deliveries)
+	}
+}
+
+func TestSinkErrorsAreCounted(t *testing.T) {
+	source := NewUDPSource("127.0.0.1:0")
+	for i := 0; i < 2; i++ {
+		if err := source.Close(); err != nil {
+			t.Fatalf("closing the source, attempt %d: %v", i+1, err)
+		}
+	}
+	// A closed sink fails every write
+	sink := NewUDPSink(source.LocalAddr().String())
+	sink.Close()
+
+	sim := NewSimulator(NewVirtualClock(time.Unix(0, 0)), 999, sink, net.ParseIP("10.0.0.2"))
+	linkConfigs := []LinkConfig{NewDelayLinkConfig(time.Millisecond, QueueConfig{}, 0, 999)}
+	sim.SetRouter(NewBroadcastSimulator(ToNeighborsMap(linkConfigs)))
+	sim.Start(context.Background(), linkConfigs, 10)
+	sim.WriteNewPacket(&DataPacket{HopsLeft: 1, Data: testUDPPacket(t, "100.64.0.4", 5000, "100.64.0.2", 5001)}, 0)
+	sim.Stop(context.Background())
+	if sim.SinkErrors() != 1 {
+		t.Fatalf("expected the failed delivery to be counted, got %d", sim.SinkErrors())
+	}
+}
+
+func TestFullChannelSinkCountsErrors(t *testing.T) {
+	sink := NewChannelSink(1)
+	sim := NewSimulator(NewVirtualClock(time.Unix(0, 0)), 999, sink, net.ParseIP("10.0.0.2"))
+	linkConfigs := []LinkConfig{NewDelayLinkConfig(time.Millisecond, QueueConfig{}, 0, 999)}
+	sim.SetRouter(NewBroadcastSimulator(ToNeighborsMap(linkConfigs)))
+	sim.Start(context.Background(), linkConfigs, 10)
+	for i := 0; i < 2; i++ {
+		sim.WriteNewPacket(&DataPacket{Id: i, HopsLeft: 1, Data: testUDPPacket(t, "100.64.0.4", 5000, "100.64.0.2", 5001)}, 0)
+	}
+	sim.Stop(context.Background())
+	if sim.SinkErrors() != 1 {
+		t.Fatalf("expected the packet that didn't fit in the channel to be counted, got %d", sim.SinkErrors())
+	}
+}
+
+func TestReturnTrafficFollowsFlow(t *testing.T) {
+	epoch := time.Unix(0, 0)
+	clock := NewVirtualClock(epoch)
+	sink := NewChannelSink(10)
+	sim := NewSimulator(clock, 999, sink, net.ParseIP("10.0.0.2"))
+	linkConfigs := []LinkConfig{
+		NewDelayLinkConfig(time.Millisecond, QueueConfig{}, 0, 999),
+		NewDelayLinkConfig(time.Millisecond, QueueConfig{}, 1, 999),
+	}
+	reverseLinkConfigs := []LinkConfig{
+		NewDelayLinkConfig(5*time.Millisecond, QueueConfig{}, 999, 0),
+		NewDelayLinkConfig(7*time.Millisecond, QueueConfig{}, 999, 1),
+	}
+	sim.SetRouter(NewBroadcastSimulator(ToNeighborsMap(linkConfigs)))
+	sim.SetReturnLinks(reverseLinkConfigs, NewBroadcastSimulator(ToNeighborsMap(reverseLinkConfigs)))
+	sim.SetDefaultReturnRoute(0, net.ParseIP("100.64.0.4"))
+	// The reply is sent once the packet that opened the flow has arrived
+	replied := make(chan struct{})
+	clock.At(epoch.Add(5*time.Millisecond), func() {
+		sim.WriteReturnPacket(&DataPacket{HopsLeft: 1, Data: testUDPPacket(t, "100.64.0.2", 5001, "10.0.0.2", 5000)})
+		close(replied)
+	})
+	// Drone 1 opens the flow, so the reply has to come back through drone 1
+	sim.WriteNewPacket(&DataPacket{HopsLeft: 1, Data: testUDPPacket(t, "100.64.0.5", 5000, "100.64.0.2", 5001)}, 1)
+	sim.Start(context.Background(), linkConfigs, 10)
+	// Stop only waits for packets the simulator already has
+	<-replied
+	sim.Stop(context.Background())
+	sink.Close()
+
+	var deliveries []TimedPacket
+	for p := range sink.Packets() {
+		deliveries = append(deliveries, p)
+	}
+	if len(deliveries) != 2 {
+		t.Fatalf("expected 2 deliveries, got %d", len(deliveries))
+	}
+	reply := deliveries[1]
+	if got := reply.Time.Sub(epoch); got != 12*time.Millisecond {
+		t.Fatalf("reply delivered at %v, expected it to take drone 1's link", got)
+	}
+	ip := gopacket.NewPacket(reply.Data, layers.LayerTypeIPv4, gopacket.Default).Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if !ip.DstIP.Equal(net.ParseIP("100.64.0.5")) {
+		t.Fatalf("reply addressed to %v", ip.DstIP)
+	}
+}
+
+func TestDuplicateFilterForgetsOldestIds(t *testing.T) {
+	filter := NewDuplicateFilter(2)
+	for _, id := range []int{1, 2, 3} {
+		if filter.IsDuplicate(id) {
+			t.Fatalf("first copy of %d reported as a duplicate", id)
+		}
+	}
+	if !filter.IsDuplicate(3) || !filter.IsDuplicate(2) {
+		t.Fatal("copies within the window weren't suppressed")
+	}
+	if filter.IsDuplicate(1) {
+		t.Fatal("id outside the window was still remembered")
+	}
+}
+
+func TestRewritesIcmpAndIPv6AndDropsUnsupported(t *testing.T) {
+	clock := NewVirtualClock(time.Unix(0, 0))
+	sink := NewChannelSink(10)
+	sim := NewSimulator(clock, 999, sink, net.ParseIP("10.0.0.2"))
+	sim.SetIPv6Address(net.ParseIP("fd00::2"))
+	linkConfigs := []LinkConfig{NewDelayLinkConfig(time.Millisecond, QueueConfig{}, 0, 999)}
+	sim.SetRouter(NewBroadcastSimulator(ToNeighborsMap(linkConfigs)))
+	sim.Start(context.Background(), linkConfigs, 10)
+
+	ip4 := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolICMPv4, SrcIP: net.ParseIP("100.64.0.4"), DstIP: net.ParseIP("100.64.0.2")}
+	icmp := &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0), Id: 1, Seq: 1}
+	ip6 := &layers.IPv6{Version: 6, HopLimit: 255, NextHeader: layers.IPProtocolICMPv6, SrcIP: net.ParseIP("fe80::1"), DstIP: net.ParseIP("ff02::2")}
+	icmp6 := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeRouterSolicitation, 0)}
+	icmp6.SetNetworkLayerForChecksum(ip6)
+	for _, packetLayers := range [][]gopacket.SerializableLayer{
+		{ip4, icmp, gopacket.Payload([]byte("ping"))},
+		{ip6, icmp6, gopacket.Payload([]byte{0, 0, 0, 0})},
+	} {
+		buf := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}, packetLayers...); err != nil {
+			t.Fatal(err)
+		}
+		sim.WriteNewPacket(&DataPacket{Data: buf.Bytes()}, 0)
+	}
+	sim.WriteNewPacket(&DataPacket{Data: []byte{0x10, 0, 0}}, 0)
+	sim.Stop(context.Background())
+	sink.Close()
+
+	var deliveries []gopacket.Packet
+	for p := range sink.Packets() {
+		deliveries = append(deliveries, decodeIP(p.Data))
+	}
+	if len(deliveries) != 2 || sim.UnsupportedPackets() != 1 {
+		t.Fatalf("expected 2 deliveries and 1 unsupported packet, got %d and %d", len(deliveries), sim.UnsupportedPackets())
+	}
+	for _, decoded := range deliveries {
+		if decoded.ErrorLayer() != nil {
+			t.Fatalf("rewritten packet doesn't decode: %v", decoded.ErrorLayer().Error())
+		}
+	}
+	if src := deliveries[0].NetworkLayer().(*layers.IPv4).SrcIP; !src.Equal(net.ParseIP("10.0.0.2")) {
+		t.Fatalf("ICMP packet sent from %v", src)
+	}
+	if src := deliveries[1].NetworkLayer().(*layers.IPv6).SrcIP; !src.Equal(net.ParseIP("fd00::2")) {
+		t.Fatalf("IPv6 packet sent from %v", src)
+	}
+	// The checksum must have been recomputed for the new source address
+	rewritten := deliveries[1].Layer(layers.LayerTypeICMPv6).(*layers.ICMPv6)
+	checksum := rewritten.Checksum
+	rewritten.SetNetworkLayerForChecksum(deliveries[1].NetworkLayer())
+	buf := gopacket.NewSerializeBuffer()
+	gopacket.SerializeLayers(buf, gopacket.SerializeOptions{ComputeChecksums: true}, rewritten, gopacket.Payload(rewritten.LayerPayload()))
+	if rewritten.Checksum != checksum {
+		t.Fatalf("ICMPv6 checksum %x, expected %x", checksum, rewritten.Checksum)
+	}
+}
+
+func TestStopWithoutStart(t *testing.T) {
+	sim := NewSimulator(NewVirtualClock(time.Unix(0, 0)), 999, NewChannelSink(10), net.ParseIP("10.0.0.2"))
+	stopped := make(chan struct{})
+	go func() {
+		sim.Stop(context.Background())
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("stopping a simulator that was never started didn't return")
+	}
+	if sim.SinkErrors() != 0 || sim.UnsupportedPackets() != 0 {
+		t.Fatalf("expected no counts before starting, got %d and %d", sim.SinkErrors(), sim.UnsupportedPackets())
+	}
+}
+
+func TestSimulatorRestarts(t *testing.T) {
+	clock := NewVirtualClock(time.Unix(0, 0))
+	sink := NewChannelSink(10)
+	sim := NewSimulator(clock, 999, sink, net.ParseIP("10.0.0.2"))
+	linkConfigs := []LinkConfig{NewDelayLinkConfig(time.Second, QueueConfig{}, 0, 999)}
+	sim.SetRouter(NewBroadcastSimulator(ToNeighborsMap(linkConfigs)))
+
+	for run := 0; run < 3; run++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		sim.Start(ctx, linkConfigs, 10)
+		id := run
+		clock.At(clock.Now(), func() {
+			sim.WriteNewPacket(&DataPacket{Id: id, Data: testUDPPacket(t, "100.64.0.4", 5000, "100.64.0.2", 5001)}, 0)
+			if id == 1 {
+				// The second run ends while its packet is on the link and is
+				// stopped without draining, which discards the packet
+				clock.After(time.Millisecond, cancel)
+			}
+		})
+		if run == 1 {
+			<-ctx.Done()
+		}
+		sim.Stop(ctx)
+		cancel()
+	}
+	sink.Close()
+
+	delivered := 0
+	for range sink.Packets() {
+		delivered++
+	}
+	if delivered != 2 {
+		t.Fatalf("expected a delivery from each drained run, got %d", delivered)
+	}
+}
+
+func TestReplacementsDrawTheirOwnRandomNumbers(t *testing.T) {
+	clock := NewVirtualClock(time.Unix(0, 0))
+	sim := NewSimulator(clock, 999, NewChannelSink(10), net.ParseIP("10.0.0.2"))
+	linkConfigs := []LinkConfig{NewDelayLinkConfig(time.Millisecond, QueueConfig{}, 0, 999)}
+	sim.SetRouter(NewBroadcastSimulator(ToNeighborsMap(linkConfigs)))
+	sim.SetSeed(1)
+
+	var seeds []int64
+	for run := 0; run < 2; run++ {
+		sim.Start(context.Background(), linkConfigs, 10)
+		sim.Stop(context.Background())
+		// The clock loop has returned, so the replacements can be counted
+		// from here
+		seeds = append(seeds, sim.replacementEnv(linkConfigs[0]).Seed, sim.replacementEnv(linkConfigs[0]).Seed)
+	}
+	if seeds[0] == 1 || seeds[0] == seeds[1] {
+		t.Fatalf("expected each replacement to get a seed of its own, got %v", seeds)
+	}
+	if seeds[2] != seeds[0] || seeds[3] != seeds[1] {
+		t.Fatalf("expected replacements to draw the same way every run, got %v", seeds)
+	}
+}
+
+func TestReplacementsKeepCounting(t *testing.T) {
+	clock := NewVirtualClock(time.Unix(0, 0))
+	sim := NewSimulator(clock, 999, NewChannelSink(10), net.ParseIP("10.0.0.2"))
+	linkConfigs := []LinkConfig{NewDelayLinkConfig(time.Millisecond, QueueConfig{}, 0, 999)}
+	sim.SetRouter(NewBroadcastSimulator(ToNeighborsMap(linkConfigs)))
+	sim.Start(context.Background(), linkConfigs, 10)
+
+	// The first packet is still on the old link, and was routed by the old
+	// router, when both are replaced
+	sim.Apply(func(Controls) {
+		sim.WriteNewPacket(&DataPacket{Id: 0, HopsLeft: 1, Data: testUDPPacket(t, "100.64.0.4", 5000, "100.64.0.2", 5001)}, 0)
+	})
+	sim.Apply(func(c Controls) {
+		if err := c.ReplaceLink(linkConfigs[0]); err != nil {
+			t.Error(err)
+		}
+		c.ReplaceRouter(NewBroadcastSimulator(ToNeighborsMap(linkConfigs)))
+	})
+	sim.Apply(func(Controls) {
+		sim.WriteNewPacket(&DataPacket{Id: 1, HopsLeft: 1, Data: testUDPPacket(t, "100.64.0.4", 5000, "100.64.0.2", 5001)}, 0)
+	})
+	sim.Stop(context.Background())
+
+	snapshot := sim.Snapshot()
+	if len(snapshot.Links) != 1 || snapshot.Links[0].Enqueued != 2 || snapshot.Links[0].Delivered != 2 {
+		t.Fatalf("expected both packets to be counted on the link, got %+v", snapshot.Links)
+	}
+	if snapshot.Router.Routed != 2 || snapshot.Router.Copies != 2 {
+		t.Fatalf("expected both packets to be counted by the router, got %+v", snapshot.Router)
+	}
+}
+
+func TestLoopFreeRouterSkipsVisitedNodes(t *testing.T) {
+	clock := NewVirtualClock(time.Unix(0, 0))
+	sink := NewChannelSink(10)
+	sim := NewSimulator(clock, 999, sink, net.ParseIP("10.0.0.2"))
+	linkConfigs := []LinkConfig{
+		NewDelayLinkConfig(time.Millisecond, QueueConfig{}, 0, 1),
+		NewDelayLinkConfig(time.Millisecond, QueueConfig{}, 1, 0),
+		NewDelayLinkConfig(time.Millisecond, QueueConfig{}, 1, 999),
+	}
+	sim.SetRouter(NewLoopFreeRouter(NewBroadcastSimulator(ToNeighborsMap(linkConfigs))))
+	sim.WriteNewPacket(&DataPacket{HopsLeft: 3, Data: testUDPPacket(t, "100.64.0.4", 5000, "100.64.0.2", 5001)}, 0)
+	sim.Start(context.Background(), linkConfigs, 10)
+	sim.Stop(context.Background())
+	sink.Close()
+
+	for _, stats := range sim.forward.stats() {
+		if stats.Src == 1 && stats.Dst == 0 && stats.Enqueued != 0 {
+			t.Fatal("a copy was sent back to the drone it came from")
+		}
+	}
+	delivered := 0
+	for range sink.Packets() {
+		delivered++
+	}
+	if delivered != 1 {
+		t.Fatalf("expected 1 delivery, got %d", delivered)
+	}
+}
+
+func TestCopiesHaveTheirOwnPath(t *testing.T) {
+	packet := &DataPacket{Path: []Hop{{Src: 0, Dst: 1}}}
+	copied := packet.Copy()
+	copied.SetPath(append(copied.GetPath(), Hop{Src: 1, Dst: 2}))
+	copied.GetPath()[0].Dst = 3
+	if len(packet.Path) != 1 || packet.Path[0].Dst != 1 {
+		t.Fatalf("copy changed the original's path to %v", packet.Path)
+	}
+}
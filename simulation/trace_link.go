@@ -2,19 +2,36 @@ package simulation
 
 import (
 	"bufio"
+	"fmt"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// Each line of a mahimahi trace is an opportunity to deliver this many bytes
+const defaultOpportunityBytes = 1504
+
 type TraceEmulator struct {
-	baseTime                  time.Time
-	sendOffsets               []time.Duration
-	currentOffsetIndex        int
-	inputQueue                chan Packet
-	outputQueue               chan Packet
+	clock       Clock
+	baseTime    time.Time
+	sendOffsets []time.Duration
+	// Bytes each opportunity can deliver
+	opportunityBytes   []int
+	currentOffsetIndex int
+	endPolicy          string
+	wraps              int
+	// Set once the trace has run out under the stop or hold policies
+	ended bool
+	// Under the hold policy, opportunities carry on every holdGap once the
+	// trace has run out, with holdBytes each
+	holdGap                   time.Duration
+	holdBytes                 int
+	nextHold                  time.Time
+	queue                     QueueDiscipline
+	deliveryScheduled         bool
 	havePacketInTransit       bool
 	packetInTransit           Packet
 	bytesLeftInTransit        int
@@ -22,7 +39,10 @@ type TraceEmulator struct {
 	src                       Address
 	dst                       Address
 	incomingPacketCallback    func(Packet)
-	lossEmulator              *LossEmulator
+	outgoingPacketCallback    func(Packet)
+	droppedPacketCallback     func(Packet, DropReason)
+	loss                      LossModel
+	counters                  linkCounters
 }
 
 func (t *TraceEmulator) SrcAddr() Address {
@@ -33,7 +53,9 @@ func (t *TraceEmulator) DstAddr() Address {
 	return t.dst
 }
 
-func loadTrace(filename string) []time.Duration {
+// Reads a trace file, where each line is "offset_ms" or "offset_ms bytes".
+// Lines without a byte count deliver defaultBytes.
+func loadTrace(filename string, defaultBytes int) ([]time.Duration, []int) {
 	file, err := os.Open(filename)
 	if err != nil {
 		panic(err)
@@ -42,79 +64,251 @@ func loadTrace(filename string) []time.Duration {
 
 	scanner := bufio.NewScanner(file)
 	var sendOffsets []time.Duration
+	var opportunityBytes []int
 	for scanner.Scan() {
-		nextSend, err := strconv.Atoi(scanner.Text())
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		} else if len(fields) > 2 {
+			panic(fmt.Sprintf("bad trace line %q in %s", scanner.Text(), filename))
+		}
+		nextSend, err := strconv.Atoi(fields[0])
 		if err != nil {
 			panic(err)
 		}
+		bytes := defaultBytes
+		if len(fields) == 2 {
+			if bytes, err = strconv.Atoi(fields[1]); err != nil {
+				panic(err)
+			}
+		}
 		nextSendOffset := time.Duration(nextSend) * time.Millisecond
 		sendOffsets = append(sendOffsets, nextSendOffset)
+		opportunityBytes = append(opportunityBytes, bytes)
+	}
+	return sendOffsets, opportunityBytes
+}
+
+// Returns the spacing and size of opportunities that keep up the rate of the
+// last second of the trace.
+func holdRate(sendOffsets []time.Duration, opportunityBytes []int) (time.Duration, int) {
+	last := sendOffsets[len(sendOffsets)-1]
+	count, bytes := 0, 0
+	for i := len(sendOffsets) - 1; i >= 0 && sendOffsets[i] > last-time.Second; i-- {
+		count++
+		bytes += opportunityBytes[i]
+	}
+	return time.Second / time.Duration(count), bytes / count
+}
+
+// Loads the trace in filename for a link, with opportunityBytes at each line
+// that doesn't give its own byte count, or defaultOpportunityBytes if it is 0.
+func readTrace(filename string, opportunityBytes int) ([]time.Duration, []int) {
+	if opportunityBytes == 0 {
+		opportunityBytes = defaultOpportunityBytes
 	}
-	return sendOffsets
+	sendOffsets, bytesPerOpportunity := loadTrace(filename, opportunityBytes)
+	if len(sendOffsets) == 0 {
+		panic(fmt.Sprintf("no delivery opportunities in %s", filename))
+	}
+	return sendOffsets, bytesPerOpportunity
+}
+
+// NewTraceEmulator delivers opportunityBytes at each line of the trace that
+// doesn't give its own byte count, or defaultOpportunityBytes if it is 0.
+// Packets larger than an opportunity take as many as they need.
+//
+// endPolicy says what happens when the trace runs out. With "loop" (or "")
+// it starts over, with "stop" the link drops everything from then on, and
+// with "hold" it keeps delivering at the rate of the trace's last second. A
+// loss trace follows the trace, starting over when it does and otherwise
+// keeping its last probability, so the two stay in step however long the
+// run is.
+//
+// The link is at startOffset into the trace at epoch, so links that share an
+// epoch replay their traces in step. A looping trace wraps startOffset
+// around its length.
+func NewTraceEmulator(clock Clock, epoch time.Time, startOffset time.Duration, filename string, opportunityBytes int, endPolicy string, loss LossModel, queue QueueDiscipline, src Address, dst Address) *TraceEmulator {
+	sendOffsets, bytesPerOpportunity := readTrace(filename, opportunityBytes)
+	return newTraceEmulator(clock, epoch, startOffset, sendOffsets, bytesPerOpportunity, endPolicy, loss, queue, src, dst)
 }
 
-func NewTraceEmulator(filename string, lossTrace string, maxQueueSize int, src Address, dst Address) TraceEmulator {
-	now := time.Now()
+// Builds a trace link from a trace readTrace has already loaded.
+func newTraceEmulator(clock Clock, epoch time.Time, startOffset time.Duration, sendOffsets []time.Duration, bytesPerOpportunity []int, endPolicy string, loss LossModel, queue QueueDiscipline, src Address, dst Address) *TraceEmulator {
+	if endPolicy == "" {
+		endPolicy = "loop"
+	} else if endPolicy != "loop" && endPolicy != "stop" && endPolicy != "hold" {
+		panic("unsupported trace end policy provided")
+	}
+	holdGap, holdBytes := holdRate(sendOffsets, bytesPerOpportunity)
+	if period := sendOffsets[len(sendOffsets)-1]; endPolicy == "loop" && period > 0 {
+		startOffset %= period
+	}
+	// Where offset 0 of the trace falls
+	baseTime := epoch.Add(-startOffset)
+	if lossTrace, ok := loss.(*LossEmulator); ok {
+		lossTrace.followTrace(baseTime)
+	}
 	log.WithFields(log.Fields{
-		"event": "start_trace",
-		"src":   src,
-		"dst":   dst,
-	}).WithTime(now).Info()
-	return TraceEmulator{
-		baseTime:                  now,
-		sendOffsets:               loadTrace(filename),
+		"event":  "start_trace",
+		"src":    src,
+		"dst":    dst,
+		"offset": startOffset.Milliseconds(),
+	}).WithTime(baseTime).Info()
+	t := &TraceEmulator{
+		clock:                     clock,
+		baseTime:                  baseTime,
+		sendOffsets:               sendOffsets,
+		opportunityBytes:          bytesPerOpportunity,
 		currentOffsetIndex:        0,
-		inputQueue:                make(chan Packet, maxQueueSize),
-		outputQueue:               make(chan Packet, maxQueueSize),
+		endPolicy:                 endPolicy,
+		holdGap:                   holdGap,
+		holdBytes:                 holdBytes,
+		queue:                     queue,
 		havePacketInTransit:       false,
 		packetInTransit:           &DataPacket{},
 		bytesLeftInDeliveryWindow: 0,
 		bytesLeftInTransit:        0,
 		src:                       src,
 		dst:                       dst,
-		lossEmulator:              NewLossEmulator(now, lossTrace),
+		loss:                      loss,
+		counters:                  newLinkCounters(),
 	}
+	queue.SetOnDroppedPacket(func(p Packet, reason DropReason) {
+		t.counters.countDrop(reason)
+		t.droppedPacketCallback(p, reason)
+	})
+	return t
 }
 
 func (t *TraceEmulator) nextReleaseTime() time.Time {
+	if t.ended {
+		return t.nextHold
+	}
 	return t.baseTime.Add(t.sendOffsets[t.currentOffsetIndex])
 }
 
+// Whether the link has run out of trace for good.
+func (t *TraceEmulator) stopped() bool {
+	return t.ended && t.endPolicy == "stop"
+}
+
 func (t *TraceEmulator) skipUnusedSlots(arrivalTime time.Time) {
 	releaseTime := t.nextReleaseTime()
-	for releaseTime.Before(arrivalTime) {
+	for !t.ended && releaseTime.Before(arrivalTime) {
 		t.useDeliverySlot()
 		releaseTime = t.nextReleaseTime()
 	}
+	if t.ended && !t.stopped() && releaseTime.Before(arrivalTime) {
+		skipped := (arrivalTime.Sub(releaseTime) + t.holdGap - 1) / t.holdGap
+		t.nextHold = t.nextHold.Add(skipped * t.holdGap)
+	}
 }
 
 func (t *TraceEmulator) useDeliverySlot() {
+	if t.ended {
+		t.bytesLeftInDeliveryWindow = t.holdBytes
+		t.nextHold = t.nextHold.Add(t.holdGap)
+		return
+	}
+	t.bytesLeftInDeliveryWindow = t.opportunityBytes[t.currentOffsetIndex]
 	t.currentOffsetIndex++
-	if t.currentOffsetIndex == len(t.sendOffsets) {
+	if t.currentOffsetIndex < len(t.sendOffsets) {
+		return
+	}
+
+	end := t.baseTime.Add(t.sendOffsets[len(t.sendOffsets)-1])
+	if t.endPolicy == "loop" {
 		t.currentOffsetIndex = 0
-		t.baseTime = t.baseTime.Add(t.sendOffsets[len(t.sendOffsets)-1])
+		t.baseTime = end
+		t.wraps++
+		if lossTrace, ok := t.loss.(*LossEmulator); ok {
+			lossTrace.restart(end)
+		}
+		log.WithFields(log.Fields{
+			"event": "trace_wrapped",
+			"src":   t.src,
+			"dst":   t.dst,
+			"wraps": t.wraps,
+		}).WithTime(end).Info()
+		return
 	}
-	t.bytesLeftInDeliveryWindow = 1504
+	// Stats report the trace as at its end from now on
+	t.currentOffsetIndex = len(t.sendOffsets) - 1
+	t.ended = true
+	t.nextHold = end.Add(t.holdGap)
+	log.WithFields(log.Fields{
+		"event":  "trace_ended",
+		"src":    t.src,
+		"dst":    t.dst,
+		"policy": t.endPolicy,
+	}).WithTime(end).Info()
 }
 
-func (t *TraceEmulator) waitForNextDeliveryOpportunity() {
-	releaseTime := t.nextReleaseTime()
-	waitTime := releaseTime.Sub(time.Now())
-	if waitTime > 0 {
-		time.Sleep(waitTime)
+func (t *TraceEmulator) scheduleNextDeliveryOpportunity() {
+	if t.deliveryScheduled {
+		return
+	}
+	if t.stopped() {
+		t.dropEverything()
+		return
 	}
+	// Delivery slots that went by while the link was idle can't be used
+	if !t.havePacketInTransit {
+		t.skipUnusedSlots(t.clock.Now())
+		// The trace may have run out while the link was idle
+		if t.stopped() {
+			t.dropEverything()
+			return
+		}
+	}
+	t.deliveryScheduled = true
+	t.clock.At(t.nextReleaseTime(), t.onDeliveryOpportunity)
 }
 
+func (t *TraceEmulator) onDeliveryOpportunity() {
+	t.useDeliverySlot()
+	if t.havePacketInTransit {
+		t.sendPartialPacket()
+	}
+	t.sendNewPacketsImmediatelyIfPossible()
+	// Packets written to the link while this slot was being used are
+	// already queued, so only reschedule once the slot is finished
+	t.deliveryScheduled = false
+	if t.havePacketInTransit || t.queue.Len() > 0 {
+		t.scheduleNextDeliveryOpportunity()
+	}
+}
+
+// Drops the packets left on a link whose trace has stopped.
+func (t *TraceEmulator) dropEverything() {
+	if t.havePacketInTransit {
+		t.havePacketInTransit = false
+		t.counters.countDrop(DropTraceEnded)
+		t.droppedPacketCallback(t.packetInTransit, DropTraceEnded)
+	}
+	for {
+		p := t.readIncomingPacketIfAvailable()
+		if p == nil {
+			return
+		}
+		t.counters.countDrop(DropTraceEnded)
+		t.droppedPacketCallback(p, DropTraceEnded)
+	}
+}
+
+// Sends as much of the packet in transit as this slot has room for, which is
+// the rest of it unless it is larger than a whole slot.
 func (t *TraceEmulator) sendPartialPacket() {
+	if t.bytesLeftInTransit > t.bytesLeftInDeliveryWindow {
+		t.bytesLeftInTransit -= t.bytesLeftInDeliveryWindow
+		t.bytesLeftInDeliveryWindow = 0
+		return
+	}
 	t.havePacketInTransit = false
 	t.bytesLeftInDeliveryWindow -= t.bytesLeftInTransit
 	t.bytesLeftInTransit = 0
-	t.outputQueue <- t.packetInTransit
-}
-
-func (t *TraceEmulator) sendFullPacket(p Packet) {
-	t.bytesLeftInDeliveryWindow -= len(p.GetData())
-	t.outputQueue <- p
+	t.sendPacket(t.packetInTransit)
 }
 
 func (t *TraceEmulator) sendNewPacketsImmediatelyIfPossible() {
@@ -123,10 +317,14 @@ func (t *TraceEmulator) sendNewPacketsImmediatelyIfPossible() {
 		if p == nil {
 			t.bytesLeftInDeliveryWindow = 0
 			return
+		} else if t.loss.Drop(t.clock.Now()) {
+			t.counters.countDrop(t.loss.Reason())
+			t.droppedPacketCallback(p, t.loss.Reason())
+			continue
 		} else {
 			if len(p.GetData()) <= t.bytesLeftInDeliveryWindow {
 				t.bytesLeftInDeliveryWindow -= len(p.GetData())
-				t.outputQueue <- p
+				t.sendPacket(p)
 			} else {
 				t.havePacketInTransit = true
 				t.packetInTransit = p
@@ -137,76 +335,61 @@ func (t *TraceEmulator) sendNewPacketsImmediatelyIfPossible() {
 	}
 }
 
-// Whatever simulator is running should be
-// calling this function in a loop
-func (t *TraceEmulator) ApplyEmulation() {
-	// If there is a packet in transit,
-	// we want to send it as soon as we can
-	for t.havePacketInTransit {
-		// Can't have leftovers in this packet because
-		// packet size has to be <= size of delivery slot
-		t.waitForNextDeliveryOpportunity()
-		t.useDeliverySlot()
-		t.sendPartialPacket()
-		t.sendNewPacketsImmediatelyIfPossible()
-	}
+func (t *TraceEmulator) SetOnIncomingPacket(callback func(Packet)) {
+	t.incomingPacketCallback = callback
+}
 
-	p := t.readIncomingPacket()
-	t.skipUnusedSlots(time.Now())
-	if !t.lossEmulator.Drop(time.Now()) {
-		t.waitForNextDeliveryOpportunity()
-		t.useDeliverySlot()
-		t.sendFullPacket(p)
-		t.sendNewPacketsImmediatelyIfPossible()
-	}
+func (t *TraceEmulator) SetOnOutgoingPacket(callback func(Packet)) {
+	t.outgoingPacketCallback = callback
 }
 
-func (t *TraceEmulator) SetOnIncomingPacket(callback func(Packet)) {
-	t.incomingPacketCallback = callback
+func (t *TraceEmulator) SetOnDroppedPacket(callback func(Packet, DropReason)) {
+	t.droppedPacketCallback = callback
 }
 
 func (t *TraceEmulator) onIncomingPacket(p Packet) {
 	t.incomingPacketCallback(p)
 }
 
-func (t *TraceEmulator) readIncomingPacket() Packet {
-	p := <-t.inputQueue
-	t.onIncomingPacket(p)
-	return p
-}
-
 func (t *TraceEmulator) readIncomingPacketIfAvailable() Packet {
-	select {
-	case p := <-t.inputQueue:
-		t.onIncomingPacket(p)
-		return p
-	default:
+	p := t.queue.Dequeue(t.clock.Now())
+	if p == nil {
 		return nil
 	}
+	t.onIncomingPacket(p)
+	return p
 }
 
 func (t *TraceEmulator) WriteIncomingPacket(p Packet) {
-	select {
-	case t.inputQueue <- p:
-		log.WithFields(log.Fields{
-			"event": "packet_entered_link",
-			"id":    p.GetId(),
-			"src":   t.src,
-			"dst":   t.dst,
-		}).Info()
-	default:
-		// Do nothing
-
+	if !t.queue.Enqueue(p, t.clock.Now()) {
+		return
 	}
+	t.counters.countIn(p)
+	log.WithFields(log.Fields{
+		"event": "packet_entered_link",
+		"id":    p.GetId(),
+		"src":   t.src,
+		"dst":   t.dst,
+	}).WithTime(t.clock.Now()).Info()
+	t.scheduleNextDeliveryOpportunity()
 }
 
-func (t *TraceEmulator) ReadOutgoingPacket() Packet {
-	p := <-t.outputQueue
+func (t *TraceEmulator) sendPacket(p Packet) {
 	log.WithFields(log.Fields{
 		"event": "packet_left_link",
 		"id":    p.GetId(),
 		"src":   t.src,
 		"dst":   t.dst,
-	}).Info()
-	return p
+	}).WithTime(t.clock.Now()).Info()
+	t.counters.countOut(p)
+	t.outgoingPacketCallback(p)
+}
+
+func (t *TraceEmulator) Stats() LinkStats {
+	stats := t.counters.stats(t.src, t.dst, t.queue)
+	if t.havePacketInTransit {
+		stats.Queued++
+	}
+	stats.TraceOffset = t.sendOffsets[t.currentOffsetIndex]
+	return stats
 }
@@ -0,0 +1,164 @@
+package simulation
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTraceOpportunitySizes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	trace := filepath.Join(dir, "link.pps")
+	if err := ioutil.WriteFile(trace, []byte("1 100\n2\n3 10\n4\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	epoch := time.Unix(0, 0)
+	clock := NewVirtualClock(epoch)
+	link := NewTraceEmulator(clock, epoch, 0, trace, 40, "loop", noLoss{}, NewDropTailQueue(10), 0, 1)
+	link.SetOnIncomingPacket(func(Packet) {})
+	link.SetOnDroppedPacket(func(Packet, DropReason) { t.Fatal("unexpected drop") })
+	var arrivals []time.Duration
+	link.SetOnOutgoingPacket(func(Packet) { arrivals = append(arrivals, clock.Now().Sub(epoch)) })
+	clock.At(epoch, func() {
+		for i := 0; i < 5; i++ {
+			link.WriteIncomingPacket(&DataPacket{Id: i, Data: testUDPPacket(t, "100.64.0.4", 5000, "100.64.0.2", 5001)})
+		}
+	})
+	clock.RunUntilIdle()
+
+	// 33 byte packets: three fit in the first 100 byte opportunity, the
+	// fourth finishes in the second, and the fifth takes the 10 byte third
+	// and part of the fourth
+	expected := []time.Duration{time.Millisecond, time.Millisecond, time.Millisecond, 2 * time.Millisecond, 4 * time.Millisecond}
+	if len(arrivals) != len(expected) {
+		t.Fatalf("expected arrivals at %v, got %v", expected, arrivals)
+	}
+	for i := range expected {
+		if arrivals[i] != expected[i] {
+			t.Fatalf("expected arrivals at %v, got %v", expected, arrivals)
+		}
+	}
+}
+
+func TestTraceEndPolicies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	trace := filepath.Join(dir, "link.pps")
+	if err := ioutil.WriteFile(trace, []byte("1\n2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each opportunity fits one 33 byte packet, so the third packet is
+	// after the end of the trace. Holding keeps up the trace's two
+	// opportunities a second.
+	for policy, expected := range map[string][]time.Duration{
+		"loop": {time.Millisecond, 2 * time.Millisecond, 3 * time.Millisecond},
+		"stop": {time.Millisecond, 2 * time.Millisecond},
+		"hold": {time.Millisecond, 2 * time.Millisecond, 502 * time.Millisecond},
+	} {
+		epoch := time.Unix(0, 0)
+		clock := NewVirtualClock(epoch)
+		link := NewTraceEmulator(clock, epoch, 0, trace, 40, policy, noLoss{}, NewDropTailQueue(10), 0, 1)
+		link.SetOnIncomingPacket(func(Packet) {})
+		var drops []DropReason
+		link.SetOnDroppedPacket(func(p Packet, reason DropReason) { drops = append(drops, reason) })
+		var arrivals []time.Duration
+		link.SetOnOutgoingPacket(func(Packet) { arrivals = append(arrivals, clock.Now().Sub(epoch)) })
+		clock.At(epoch, func() {
+			for i := 0; i < 3; i++ {
+				link.WriteIncomingPacket(&DataPacket{Id: i, Data: testUDPPacket(t, "100.64.0.4", 5000, "100.64.0.2", 5001)})
+			}
+		})
+		clock.RunUntilIdle()
+
+		if len(arrivals) != len(expected) {
+			t.Fatalf("%s: expected arrivals at %v, got %v", policy, expected, arrivals)
+		}
+		for i := range expected {
+			if arrivals[i] != expected[i] {
+				t.Fatalf("%s: expected arrivals at %v, got %v", policy, expected, arrivals)
+			}
+		}
+		if policy == "stop" && (len(drops) != 1 || drops[0] != DropTraceEnded) {
+			t.Fatalf("expected the last packet to be dropped when the trace stopped, got %v", drops)
+		} else if policy != "stop" && len(drops) != 0 {
+			t.Fatalf("%s: unexpected drops %v", policy, drops)
+		}
+	}
+}
+
+func TestTraceStopWhileIdle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	trace := filepath.Join(dir, "link.pps")
+	if err := ioutil.WriteFile(trace, []byte("1\n2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is written until the trace has already run out, so the link
+	// only finds out it has stopped when the packet arrives
+	epoch := time.Unix(0, 0)
+	clock := NewVirtualClock(epoch)
+	link := NewTraceEmulator(clock, epoch, 0, trace, 40, "stop", noLoss{}, NewDropTailQueue(10), 0, 1)
+	link.SetOnIncomingPacket(func(Packet) {})
+	var drops []DropReason
+	link.SetOnDroppedPacket(func(p Packet, reason DropReason) { drops = append(drops, reason) })
+	link.SetOnOutgoingPacket(func(Packet) { t.Fatalf("unexpected delivery at %v", clock.Now().Sub(epoch)) })
+	clock.At(epoch.Add(10*time.Millisecond), func() {
+		link.WriteIncomingPacket(&DataPacket{Id: 0, Data: testUDPPacket(t, "100.64.0.4", 5000, "100.64.0.2", 5001)})
+	})
+	clock.RunUntilIdle()
+
+	if len(drops) != 1 || drops[0] != DropTraceEnded {
+		t.Fatalf("expected the packet to be dropped because the trace stopped, got %v", drops)
+	}
+}
+
+func TestTraceStartOffsets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	trace := filepath.Join(dir, "link.pps")
+	if err := ioutil.WriteFile(trace, []byte("10\n20\n30\n40\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every link is built 7ms after the epoch they share, and gets a packet
+	// then. Offsets past the end of a looping trace wrap around.
+	for startOffset, expected := range map[time.Duration]time.Duration{
+		0:                     10 * time.Millisecond,
+		15 * time.Millisecond: 15 * time.Millisecond,
+		55 * time.Millisecond: 15 * time.Millisecond,
+	} {
+		epoch := time.Unix(0, 0)
+		clock := NewVirtualClock(epoch)
+		var arrival time.Duration
+		clock.At(epoch.Add(7*time.Millisecond), func() {
+			config := NewTraceLinkConfig(trace, 0, "loop", startOffset, false, LossConfig{}, QueueConfig{}, 0, 1)
+			link := config.ToLinkEmulator(LinkEnvironment{Clock: clock, MaxQueueLength: 10, Seed: 1, Epoch: epoch})
+			link.SetOnIncomingPacket(func(Packet) {})
+			link.SetOnDroppedPacket(func(Packet, DropReason) { t.Fatal("unexpected drop") })
+			link.SetOnOutgoingPacket(func(Packet) { arrival = clock.Now().Sub(epoch) })
+			link.WriteIncomingPacket(&DataPacket{Data: testUDPPacket(t, "100.64.0.4", 5000, "100.64.0.2", 5001)})
+		})
+		clock.RunUntilIdle()
+		if arrival != expected {
+			t.Fatalf("expected a start offset of %v to deliver at %v, got %v", startOffset, expected, arrival)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package simulation
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/songgao/water"
+)
+
+// TunDevice is both a source and a sink. Packets routed into the device by
+// the kernel enter the simulation, and packets that reach the base are
+// written back to it.
+type TunDevice struct {
+	dev  *water.Interface
+	mtu  int
+	once sync.Once
+}
+
+// ErrPacketTooLarge is returned for a packet read from a TunDevice that is
+// larger than its MTU. The packet is discarded, and the device can still be
+// read from.
+var ErrPacketTooLarge = errors.New("packet is over the device's MTU")
+
+// Room for any packet a device with the kernel's default MTU of 1500 carries
+const defaultTunBuffer = 2000
+
+// NewTunDevice reads packets of up to mtu bytes from dev, or up to 2000 bytes
+// if mtu is 0.
+func NewTunDevice(dev *water.Interface, mtu int) *TunDevice {
+	if mtu == 0 {
+		mtu = defaultTunBuffer
+	}
+	return &TunDevice{dev: dev, mtu: mtu}
+}
+
+func (d *TunDevice) Name() string {
+	return d.dev.Name()
+}
+
+func (d *TunDevice) ReadPacket() ([]byte, time.Time, error) {
+	// A read stops at the end of the buffer, so a packet that fills the
+	// spare byte would otherwise have been cut short
+	packetBuf := make([]byte, d.mtu+1)
+	n, err := d.dev.Read(packetBuf)
+	if err != nil {
+		return nil, time.Time{}, err
+	} else if n > d.mtu {
+		return nil, time.Time{}, fmt.Errorf("%w: read from %s with a %d byte MTU", ErrPacketTooLarge, d.dev.Name(), d.mtu)
+	}
+	return packetBuf[:n], time.Now(), nil
+}
+
+func (d *TunDevice) WritePacket(data []byte, t time.Time) error {
+	_, err := d.dev.Write(data)
+	return err
+}
+
+// Close is safe to call once for each role the device plays.
+func (d *TunDevice) Close() error {
+	var err error
+	d.once.Do(func() {
+		err = d.dev.Close()
+	})
+	return err
+}
@@ -0,0 +1,74 @@
+package simulation
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// UDPSource receives packets tunneled over UDP, one IP packet per datagram.
+type UDPSource struct {
+	conn *net.UDPConn
+	once sync.Once
+}
+
+func NewUDPSource(listenAddr string) *UDPSource {
+	addr, err := net.ResolveUDPAddr("udp", listenAddr)
+	if err != nil {
+		panic(err)
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		panic(err)
+	}
+	return &UDPSource{conn: conn}
+}
+
+func (s *UDPSource) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *UDPSource) ReadPacket() ([]byte, time.Time, error) {
+	packetBuf := make([]byte, 65536)
+	n, _, err := s.conn.ReadFromUDP(packetBuf)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return packetBuf[:n], time.Now(), nil
+}
+
+// Close is safe to call more than once.
+func (s *UDPSource) Close() error {
+	var err error
+	s.once.Do(func() {
+		err = s.conn.Close()
+	})
+	return err
+}
+
+// UDPSink tunnels delivered packets to a remote address over UDP, one IP
+// packet per datagram.
+type UDPSink struct {
+	conn *net.UDPConn
+}
+
+func NewUDPSink(remoteAddr string) *UDPSink {
+	addr, err := net.ResolveUDPAddr("udp", remoteAddr)
+	if err != nil {
+		panic(err)
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		panic(err)
+	}
+	return &UDPSink{conn: conn}
+}
+
+func (s *UDPSink) WritePacket(data []byte, t time.Time) error {
+	_, err := s.conn.Write(data)
+	return err
+}
+
+func (s *UDPSink) Close() error {
+	return s.conn.Close()
+}
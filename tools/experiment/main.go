@@ -9,6 +9,7 @@ import (
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -22,12 +23,34 @@ import (
 
 func getDroneLink(linkConfig config.DroneLinkConfig, src string, dst string) config.ConfigEntry {
 	if linkConfig.Type == "fixed_delay" {
-		return config.NewDelayEntry(linkConfig.Delay)
+		return config.NewDelayEntry(linkConfig.Delay, linkConfig.Loss)
+	} else if linkConfig.Type == "rate" {
+		return config.NewRateEntry(linkConfig.Delay, linkConfig.Rate, linkConfig.Burst)
+	} else if linkConfig.Type == "mobile" {
+		return config.NewMobileEntry()
 	} else {
 		panic("invalid drone to drone link config type")
 	}
 }
 
+func reverseTopology(simConfig config.SimulatorConfig) map[string](map[string]interface{}) {
+	if len(simConfig.ReverseBaseLinks) == 0 {
+		return nil
+	}
+	topology := make(map[string](map[string]interface{}))
+	topology["base"] = make(map[string]interface{})
+	for strDst, trace := range simConfig.ReverseBaseLinks {
+		topology["base"][strDst] = config.NewTraceEntry(trace)
+		topology[strDst] = make(map[string]interface{})
+		for strOther, _ := range simConfig.ReverseBaseLinks {
+			if strDst != strOther {
+				topology[strDst][strOther] = getDroneLink(simConfig.DroneLinks, strDst, strOther)
+			}
+		}
+	}
+	return topology
+}
+
 func writeGeneralConfig(simConfig config.SimulatorConfig, outputDir string) {
 	generalTopology := make(map[string](map[string]interface{}))
 	for strSrc, trace := range simConfig.BaseLinks {
@@ -40,7 +63,12 @@ func writeGeneralConfig(simConfig config.SimulatorConfig, outputDir string) {
 			}
 		}
 	}
-	generalConfig := simulatorConfig.Config{Topology: generalTopology, General: simConfig.Global}
+	generalConfig := simulatorConfig.Config{
+		Topology:        generalTopology,
+		ReverseTopology: reverseTopology(simConfig),
+		General:         simConfig.Global,
+		Mobility:        simConfig.Mobility,
+	}
 	data, err := json.Marshal(generalConfig)
 	if err != nil {
 		panic(err)
@@ -101,7 +129,10 @@ func processConfig(filename string, fullDir string, linksDir string) config.Conf
 	return config
 }
 
-func run(cmdStr string, tag string, printStdout bool, printStderr bool) *exec.Cmd {
+// Starts cmdStr, printing the output asked for with tag in front of each line.
+// The returned WaitGroup is done once that output has all been read, which
+// must happen before the command is waited on.
+func run(cmdStr string, tag string, printStdout bool, printStderr bool) (*exec.Cmd, *sync.WaitGroup) {
 	cmd := exec.Command("bash", "-c", cmdStr)
 	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 	stdout, _ := cmd.StdoutPipe()
@@ -111,8 +142,11 @@ func run(cmdStr string, tag string, printStdout bool, printStderr bool) *exec.Cm
 		panic(err)
 	}
 
+	var readers sync.WaitGroup
 	if printStdout {
+		readers.Add(1)
 		go func() {
+			defer readers.Done()
 			buf := bufio.NewReader(stdout)
 			for {
 				line, _, err := buf.ReadLine()
@@ -125,7 +159,9 @@ func run(cmdStr string, tag string, printStdout bool, printStderr bool) *exec.Cm
 	}
 
 	if printStderr {
+		readers.Add(1)
 		go func() {
+			defer readers.Done()
 			buf := bufio.NewReader(stderr)
 			for {
 				line, _, err := buf.ReadLine()
@@ -137,19 +173,30 @@ func run(cmdStr string, tag string, printStdout bool, printStderr bool) *exec.Cm
 		}()
 	}
 
-	return cmd
+	return cmd, &readers
 
 }
 
+// Returns how many whole seconds the sender spends waiting between packets,
+// rounded up. Bursty traffic waits as long overall, just all at once between
+// bursts.
+func senderSeconds(config config.Config) int {
+	waitMillis := config.Sender.Count * config.Sender.Wait
+	return (waitMillis + 999) / 1000
+}
+
 func runSimulator(config config.Config, inputFile string, outputFile string) {
 	receiverCmd := fmt.Sprintf("cd ../packet-receiver && mm-delay 1 ./packet-receiver -listen-on=%s", config.Receiver.Address)
-	receiver := run(receiverCmd, "RECV", false, true)
+	receiver, _ := run(receiverCmd, "RECV", false, true)
 	time.Sleep(time.Second * time.Duration(1))
 
 	inpath := fmt.Sprintf("%s/%s", "../experiment", inputFile)
 	outpath := fmt.Sprintf("%s/%s", "../experiment", outputFile)
-	simCmd := fmt.Sprintf("sudo ../simulator/simulator -config=%s -time=%d> %s", inpath, config.Simulator.Timeout, outpath)
-	run(simCmd, "SIM", true, true)
+	// The simulator runs while the sender is started and sending, then for
+	// Timeout more seconds to give the transmission time to finish
+	runTime := 1 + senderSeconds(config) + config.Simulator.Timeout
+	simCmd := fmt.Sprintf("sudo ../simulator/simulator -config=%s -time=%d> %s", inpath, runTime, outpath)
+	simulator, simulatorOutput := run(simCmd, "SIM", true, true)
 	time.Sleep(time.Second * time.Duration(1))
 
 	senderCmd := fmt.Sprintf(
@@ -169,13 +216,11 @@ func runSimulator(config config.Config, inputFile string, outputFile string) {
 		panic(err)
 	}
 
-	// Give ample time for the transmission to finish
-	time.Sleep(time.Second * time.Duration(config.Simulator.Timeout))
-
-	// Something goes wrong with killing simulator. I think it's because of sudo.
-	// This is a hack around that
-	if out, err := exec.Command("sudo", "killall", "simulator").CombinedOutput(); err != nil {
-		fmt.Println("killing simulator returned error: ", string(out))
+	// The simulator stops by itself once its run time is up, after giving the
+	// packets still on its links a chance to arrive
+	simulatorOutput.Wait()
+	if err := simulator.Wait(); err != nil {
+		fmt.Println("simulator returned error: ", err)
 	}
 	syscall.Kill(-receiver.Process.Pid, syscall.SIGTERM)
 	time.Sleep(time.Second * time.Duration(1))
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+
+	. "github.com/aditiharini/simulator-proxy/simulation"
+)
+
+// Prints a loss model fit to a trace, ready to use as a link's "loss" in a
+// simulator topology.
+func main() {
+	trace := flag.String("trace", "", "delivery trace (.pps) of the link")
+	loss := flag.String("loss", "", "loss trace (.loss) of the link")
+	states := flag.Int("states", 2, "number of states in the fitted model")
+	flag.Parse()
+
+	fit := FitMarkovLoss(*trace, *loss, *states)
+	var entry map[string]interface{}
+	if fit.Type == "gilbert_elliott" {
+		entry = map[string]interface{}{
+			"type":     fit.Type,
+			"p":        fit.P,
+			"r":        fit.R,
+			"goodLoss": fit.GoodLoss,
+			"badLoss":  fit.BadLoss,
+		}
+	} else {
+		entry = map[string]interface{}{
+			"type":        fit.Type,
+			"states":      fit.States,
+			"transitions": fit.Transitions,
+		}
+	}
+	output, err := json.MarshalIndent(entry, "", "    ")
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(string(output))
+}
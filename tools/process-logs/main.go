@@ -7,7 +7,9 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"math"
 	"os"
+	"sort"
 	"strings"
 	"time"
 
@@ -92,6 +94,14 @@ type Dataset interface {
 
 type LatencyDataset struct {
 	data []LatencyData
+	// Changes made to the simulation mid-run, marked among the packets
+	changes []ChangeMark
+}
+
+// A change to the running simulation, such as a link going down
+type ChangeMark struct {
+	time  OffsetTime
+	label string
 }
 
 func (ld *LatencyDataset) getColumnNames() []string {
@@ -134,10 +144,314 @@ func (lg *LatencyDataset) toCsv(filename string) {
 	defer w.Flush()
 
 	experimentType := experimentType(filename)
-	columns := []string{"time", "latency", "dropped", "type"}
+	columns := []string{"time", "latency", "dropped", "type", "event"}
 	w.Write(columns)
+	sort.SliceStable(lg.data, func(i, j int) bool { return lg.data[i].time.offset < lg.data[j].time.offset })
+	changes := lg.changes
+	writeChanges := func(until time.Duration) {
+		for len(changes) > 0 && changes[0].time.offset <= until {
+			offset := fmt.Sprintf("%d", changes[0].time.offset.Milliseconds())
+			w.Write([]string{offset, "", "", experimentType, changes[0].label})
+			changes = changes[1:]
+		}
+	}
 	for _, latencyData := range lg.data {
-		w.Write(append(latencyData.toStringList(), experimentType))
+		writeChanges(latencyData.time.offset)
+		w.Write(append(latencyData.toStringList(), experimentType, ""))
+	}
+	writeChanges(math.MaxInt64)
+}
+
+// How many extra copies of each packet the routing algorithm got to the base
+type RedundancyData struct {
+	routing    string
+	received   int
+	delivered  int
+	copies     int
+	suppressed int
+}
+
+func (s Stats) calculateRedundancy() RedundancyData {
+	copies := 0
+	for _, count := range s.deliveredCopies {
+		copies += count
+	}
+	return RedundancyData{
+		routing:    s.routing,
+		received:   len(s.entryTime),
+		delivered:  len(s.firstExitTime),
+		copies:     copies,
+		suppressed: s.suppressedCopies,
+	}
+}
+
+func (rd RedundancyData) overhead() float64 {
+	if rd.delivered == 0 {
+		return 0
+	}
+	return float64(rd.copies)/float64(rd.delivered) - 1
+}
+
+func (rd RedundancyData) toCsv(filename string) {
+	file, err := os.Create(filename)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	w := csv.NewWriter(file)
+	defer w.Flush()
+
+	w.Write([]string{"routing", "received", "delivered", "copies", "suppressed", "overhead"})
+	w.Write([]string{
+		rd.routing,
+		fmt.Sprintf("%d", rd.received),
+		fmt.Sprintf("%d", rd.delivered),
+		fmt.Sprintf("%d", rd.copies),
+		fmt.Sprintf("%d", rd.suppressed),
+		fmt.Sprintf("%f", rd.overhead()),
+	})
+}
+
+// The per-link counters the simulator logs when it stops
+type LinkSummaryDataset struct {
+	links       []LinkStats
+	returnLinks []LinkStats
+}
+
+func (ls LinkSummaryDataset) toCsv(filename string) {
+	file, err := os.Create(filename)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	w := csv.NewWriter(file)
+	defer w.Flush()
+
+	w.Write([]string{"direction", "src", "dst", "enqueued", "delivered", "dropped", "flushed", "queue_drops", "queue_delay", "max_queue_delay"})
+	directions := []string{"forward", "return"}
+	for i, links := range [][]LinkStats{ls.links, ls.returnLinks} {
+		for _, link := range links {
+			w.Write([]string{
+				directions[i],
+				fmt.Sprintf("%d", link.Src),
+				fmt.Sprintf("%d", link.Dst),
+				fmt.Sprintf("%d", link.Enqueued),
+				fmt.Sprintf("%d", link.Delivered),
+				fmt.Sprintf("%d", link.Dropped),
+				fmt.Sprintf("%d", link.Queued),
+				fmt.Sprintf("%d", link.QueueDrops),
+				fmt.Sprintf("%d", link.QueueDelay.Milliseconds()),
+				fmt.Sprintf("%d", link.MaxQueueDelay.Milliseconds()),
+			})
+		}
+	}
+}
+
+// How many packets that never arrived were lost to each cause
+type DropData struct {
+	direction string
+	reason    string
+	packets   int
+}
+
+// Packets with no drop event were still on their way when the run ended
+const unknownDropReason = "unknown"
+
+func countDrops(direction string, entryTime map[PacketId]simTime, exitTime map[PacketId]simTime, dropReason map[PacketId]string) []DropData {
+	counts := make(map[string]int)
+	for id := range entryTime {
+		if _, ok := exitTime[id]; ok {
+			continue
+		}
+		reason, ok := dropReason[id]
+		if !ok {
+			reason = unknownDropReason
+		}
+		counts[reason]++
+	}
+	var reasons []string
+	for reason := range counts {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	var dropData []DropData
+	for _, reason := range reasons {
+		dropData = append(dropData, DropData{direction: direction, reason: reason, packets: counts[reason]})
+	}
+	return dropData
+}
+
+func (s Stats) calculateDrops() []DropData {
+	drops := countDrops("forward", s.entryTime, s.firstExitTime, s.dropReason)
+	return append(drops, countDrops("return", s.returnEntryTime, s.returnExitTime, s.returnDropReason)...)
+}
+
+type DropDataset struct {
+	data []DropData
+}
+
+func (dd DropDataset) toCsv(filename string) {
+	file, err := os.Create(filename)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	w := csv.NewWriter(file)
+	defer w.Flush()
+
+	w.Write([]string{"direction", "reason", "packets"})
+	for _, dropData := range dd.data {
+		w.Write([]string{dropData.direction, dropData.reason, fmt.Sprintf("%d", dropData.packets)})
+	}
+}
+
+// How often each route carried the first copy of a packet, and any copy
+type RouteData struct {
+	route  string
+	first  int
+	copies int
+}
+
+func (s Stats) calculateRouteFrequencies() []RouteData {
+	first := make(map[string]int)
+	for _, route := range s.firstRoute {
+		first[route]++
+	}
+	var routeData []RouteData
+	for route, copies := range s.routeCopies {
+		routeData = append(routeData, RouteData{route: route, first: first[route], copies: copies})
+	}
+	sort.Slice(routeData, func(i, j int) bool {
+		if routeData[i].first == routeData[j].first {
+			return routeData[i].route < routeData[j].route
+		}
+		return routeData[i].first > routeData[j].first
+	})
+	return routeData
+}
+
+type RouteDataset struct {
+	data []RouteData
+}
+
+func (rd RouteDataset) toCsv(filename string) {
+	file, err := os.Create(filename)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	w := csv.NewWriter(file)
+	defer w.Flush()
+
+	w.Write([]string{"route", "first", "copies"})
+	for _, routeData := range rd.data {
+		w.Write([]string{routeData.route, fmt.Sprintf("%d", routeData.first), fmt.Sprintf("%d", routeData.copies)})
+	}
+}
+
+// The latency of each delivered packet along the route its first copy took
+type PathLatencyData struct {
+	route string
+	LatencyData
+}
+
+func (s Stats) calculatePathLatencies() []PathLatencyData {
+	var pathLatencies []PathLatencyData
+	for id, exit := range s.firstExitTime {
+		entry, ok := s.entryTime[id]
+		if !ok {
+			continue
+		}
+		pathLatencies = append(pathLatencies, PathLatencyData{
+			route:       s.firstRoute[id],
+			LatencyData: LatencyData{time: s.getTimeAsOffsetFromGlobalStart(entry), latency: exit.Sub(entry.Time)},
+		})
+	}
+	sort.Slice(pathLatencies, func(i, j int) bool {
+		return pathLatencies[i].time.offset < pathLatencies[j].time.offset
+	})
+	return pathLatencies
+}
+
+type PathLatencyDataset struct {
+	data []PathLatencyData
+}
+
+func (pd PathLatencyDataset) toCsv(filename string) {
+	file, err := os.Create(filename)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	w := csv.NewWriter(file)
+	defer w.Flush()
+
+	w.Write([]string{"route", "time", "latency"})
+	for _, pathLatency := range pd.data {
+		w.Write([]string{
+			pathLatency.route,
+			fmt.Sprintf("%d", pathLatency.time.offset.Milliseconds()),
+			fmt.Sprintf("%d", pathLatency.latency.Milliseconds()),
+		})
+	}
+}
+
+// A packet a link reordered, duplicated or corrupted, to line up with errors
+// the application saw for the same packet id
+type ImpairmentData struct {
+	time       OffsetTime
+	id         PacketId
+	link       Link
+	impairment string
+	detail     string
+}
+
+func (s Stats) calculateImpairments() []ImpairmentData {
+	var impairmentData []ImpairmentData
+	for _, impairment := range s.impairments {
+		impairmentData = append(impairmentData, ImpairmentData{
+			time:       s.getTimeAsOffsetFromGlobalStart(impairment.Time),
+			id:         impairment.Id,
+			link:       Link{src: impairment.Src, dst: impairment.Dst},
+			impairment: strings.TrimPrefix(impairment.Event, "packet_"),
+			detail:     impairment.detail(),
+		})
+	}
+	sort.SliceStable(impairmentData, func(i, j int) bool {
+		return impairmentData[i].time.offset < impairmentData[j].time.offset
+	})
+	return impairmentData
+}
+
+type ImpairmentDataset struct {
+	data []ImpairmentData
+}
+
+func (id ImpairmentDataset) toCsv(filename string) {
+	file, err := os.Create(filename)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	w := csv.NewWriter(file)
+	defer w.Flush()
+
+	w.Write([]string{"time", "id", "src", "dst", "impairment", "detail"})
+	for _, impairment := range id.data {
+		w.Write([]string{
+			fmt.Sprintf("%d", impairment.time.offset.Milliseconds()),
+			fmt.Sprintf("%d", impairment.id),
+			fmt.Sprintf("%d", impairment.link.src),
+			fmt.Sprintf("%d", impairment.link.dst),
+			impairment.impairment,
+			impairment.detail,
+		})
 	}
 }
 
@@ -149,10 +463,22 @@ type Link struct {
 type Stats struct {
 	entryTime        map[PacketId]simTime
 	firstExitTime    map[PacketId]simTime
+	returnEntryTime  map[PacketId]simTime
+	returnExitTime   map[PacketId]simTime
 	perLinkEntryTime map[Link](map[PacketId]simTime)
 	perLinkExitTime  map[Link](map[PacketId]simTime)
 	startTime        simTime
 	perLinkStartTime map[Link]simTime
+	routing          string
+	deliveredCopies  map[PacketId]int
+	suppressedCopies int
+	linkSummary      *LinkSummaryDataset
+	dropReason       map[PacketId]string
+	returnDropReason map[PacketId]string
+	firstRoute       map[PacketId]string
+	routeCopies      map[string]int
+	changes          []ChangeEvent
+	impairments      []ImpairmentEvent
 }
 
 func (s Stats) getTimeAsOffsetFromGlobalStart(eventTime simTime) OffsetTime {
@@ -209,6 +535,19 @@ func (s Stats) calculateLatencies() []LatencyData {
 	return latencyData
 }
 
+func (s Stats) calculateReturnLatencies() []LatencyData {
+	var latencyData []LatencyData
+	for id, entry := range s.returnEntryTime {
+		offsetTime := s.getTimeAsOffsetFromGlobalStart(entry)
+		if exit, ok := s.returnExitTime[id]; ok {
+			latencyData = append(latencyData, LatencyData{time: offsetTime, latency: exit.Sub(entry.Time), dropped: false})
+		} else {
+			latencyData = append(latencyData, LatencyData{time: offsetTime, dropped: true})
+		}
+	}
+	return latencyData
+}
+
 func (s Stats) calculatePerLinkLatencies(link Link) []LatencyData {
 	var latencyData []LatencyData
 	for id, entryTime := range s.perLinkEntryTime[link] {
@@ -222,19 +561,136 @@ func (s Stats) calculatePerLinkLatencies(link Link) []LatencyData {
 	return latencyData
 }
 
+func (s Stats) calculateChanges() []ChangeMark {
+	var marks []ChangeMark
+	for _, change := range s.changes {
+		marks = append(marks, ChangeMark{time: s.getTimeAsOffsetFromGlobalStart(change.Time), label: change.label()})
+	}
+	return marks
+}
+
 type Event interface {
 	process(stats *Stats)
 }
 
+// Logged when a link, node, router or the hop limit is changed mid-run,
+// whether by a scheduled event or through the control API, or when drones
+// move in or out of range of each other
+type ChangeEvent struct {
+	Event   string  `json:"event"`
+	Src     Address `json:"src"`
+	Dst     Address `json:"dst"`
+	Node    Address `json:"node"`
+	Routing string  `json:"routing"`
+	MaxHops int     `json:"max_hops"`
+	Time    simTime `json:"time"`
+}
+
+func (e ChangeEvent) label() string {
+	switch e.Event {
+	case "node_down", "node_up":
+		return fmt.Sprintf("%s %d", e.Event, e.Node)
+	case "router_replaced":
+		return fmt.Sprintf("%s %s", e.Event, e.Routing)
+	case "max_hops_changed":
+		return fmt.Sprintf("%s %d", e.Event, e.MaxHops)
+	default:
+		return fmt.Sprintf("%s %d-%d", e.Event, e.Src, e.Dst)
+	}
+}
+
+func (e ChangeEvent) process(stats *Stats) {
+	stats.changes = append(stats.changes, e)
+}
+
+// Logged when a link reorders, duplicates or corrupts a packet. These make
+// up the impairments dataset.
+type ImpairmentEvent struct {
+	Event        string  `json:"event"`
+	Id           int     `json:"id"`
+	Src          Address `json:"src"`
+	Dst          Address `json:"dst"`
+	Time         simTime `json:"time"`
+	Displacement int     `json:"displacement"`
+	Bit          int     `json:"bit"`
+	FixChecksums bool    `json:"fix_checksums"`
+}
+
+func (e ImpairmentEvent) detail() string {
+	switch e.Event {
+	case "packet_reordered":
+		return fmt.Sprintf("overtaken by %d", e.Displacement)
+	case "packet_corrupted":
+		if e.FixChecksums {
+			return fmt.Sprintf("bit %d from the end, checksums fixed", e.Bit)
+		}
+		return fmt.Sprintf("bit %d from the end, checksums broken", e.Bit)
+	}
+	return ""
+}
+
+func (e ImpairmentEvent) process(stats *Stats) {
+	stats.impairments = append(stats.impairments, e)
+}
+
+type IgnoredEvent struct{}
+
+func (e IgnoredEvent) process(stats *Stats) {}
+
 type PacketSentEvent struct {
 	Id   int     `json:"id"`
 	Src  Address `json:"src"`
+	Path []Hop   `json:"path"`
 	Time simTime `json:"time"`
 }
 
 func (e PacketSentEvent) process(stats *Stats) {
+	route := routeName(e.Path)
 	if _, ok := stats.firstExitTime[e.Id]; !ok {
 		stats.firstExitTime[e.Id] = e.Time
+		stats.firstRoute[e.Id] = route
+	}
+	stats.deliveredCopies[e.Id]++
+	stats.routeCopies[route]++
+}
+
+// Names a route by the nodes along it, e.g. "0-1-999"
+func routeName(path []Hop) string {
+	if len(path) == 0 {
+		return ""
+	}
+	nodes := []string{fmt.Sprintf("%d", path[0].Src)}
+	for _, hop := range path {
+		nodes = append(nodes, fmt.Sprintf("%d", hop.Dst))
+	}
+	return strings.Join(nodes, "-")
+}
+
+type PacketDuplicateEvent struct {
+	Id     int  `json:"id"`
+	Return bool `json:"return"`
+}
+
+func (e PacketDuplicateEvent) process(stats *Stats) {
+	if !e.Return {
+		stats.deliveredCopies[e.Id]++
+		stats.suppressedCopies++
+	}
+}
+
+type PacketDroppedEvent struct {
+	Id     int    `json:"id"`
+	Reason string `json:"reason"`
+	Return bool   `json:"return"`
+}
+
+// A packet can have copies dropped in several places. It is put down to the
+// last copy to go.
+func (e PacketDroppedEvent) process(stats *Stats) {
+	if e.Return {
+		stats.returnDropReason[e.Id] = e.Reason
+	} else {
+		stats.dropReason[e.Id] = e.Reason
 	}
 }
 
@@ -247,6 +703,26 @@ func (e PacketReceivedEvent) process(stats *Stats) {
 	stats.entryTime[e.Id] = e.Time
 }
 
+type ReturnPacketSentEvent struct {
+	Id   int     `json:"id"`
+	Time simTime `json:"time"`
+}
+
+func (e ReturnPacketSentEvent) process(stats *Stats) {
+	if _, ok := stats.returnExitTime[e.Id]; !ok {
+		stats.returnExitTime[e.Id] = e.Time
+	}
+}
+
+type ReturnPacketReceivedEvent struct {
+	Id   int     `json:"id"`
+	Time simTime `json:"time"`
+}
+
+func (e ReturnPacketReceivedEvent) process(stats *Stats) {
+	stats.returnEntryTime[e.Id] = e.Time
+}
+
 type StartTraceEvent struct {
 	Src  Address `json:"src"`
 	Dst  Address `json:"dst"`
@@ -258,11 +734,22 @@ func (e StartTraceEvent) process(stats *Stats) {
 }
 
 type StartSimulatorEvent struct {
-	Time simTime `json:"time"`
+	Time    simTime `json:"time"`
+	Routing string  `json:"routing"`
 }
 
 func (e StartSimulatorEvent) process(stats *Stats) {
 	stats.startTime = e.Time
+	stats.routing = e.Routing
+}
+
+type StopSimulatorEvent struct {
+	Links       []LinkStats `json:"links"`
+	ReturnLinks []LinkStats `json:"return_links"`
+}
+
+func (e StopSimulatorEvent) process(stats *Stats) {
+	stats.linkSummary = &LinkSummaryDataset{links: e.Links, returnLinks: e.ReturnLinks}
 }
 
 type PacketEnteredLinkEvent struct {
@@ -306,6 +793,22 @@ func parseLogLine(data []byte) Event {
 		var packetSent PacketSentEvent
 		json.Unmarshal(data, &packetSent)
 		return packetSent
+	} else if mappedData["event"] == "packet_duplicate" {
+		var packetDuplicate PacketDuplicateEvent
+		json.Unmarshal(data, &packetDuplicate)
+		return packetDuplicate
+	} else if mappedData["event"] == "packet_dropped" {
+		var packetDropped PacketDroppedEvent
+		json.Unmarshal(data, &packetDropped)
+		return packetDropped
+	} else if mappedData["event"] == "return_packet_received" {
+		var returnPacketReceived ReturnPacketReceivedEvent
+		json.Unmarshal(data, &returnPacketReceived)
+		return returnPacketReceived
+	} else if mappedData["event"] == "return_packet_sent" {
+		var returnPacketSent ReturnPacketSentEvent
+		json.Unmarshal(data, &returnPacketSent)
+		return returnPacketSent
 	} else if mappedData["event"] == "start_trace" {
 		var startTrace StartTraceEvent
 		json.Unmarshal(data, &startTrace)
@@ -322,11 +825,35 @@ func parseLogLine(data []byte) Event {
 		var startSimulator StartSimulatorEvent
 		json.Unmarshal(data, &startSimulator)
 		return startSimulator
+	} else if mappedData["event"] == "stop_simulator" {
+		var stopSimulator StopSimulatorEvent
+		json.Unmarshal(data, &stopSimulator)
+		return stopSimulator
+	} else if mappedData["event"] == "packet_reordered" || mappedData["event"] == "packet_duplicated" || mappedData["event"] == "packet_corrupted" {
+		var impairment ImpairmentEvent
+		json.Unmarshal(data, &impairment)
+		return impairment
+	} else if isChangeEvent(mappedData["event"]) {
+		var change ChangeEvent
+		json.Unmarshal(data, &change)
+		return change
+	} else if mappedData["event"] == "serve_metrics" || mappedData["event"] == "serve_control" || mappedData["event"] == "packet_left_stage" ||
+		mappedData["event"] == "sink_write_failed" || mappedData["event"] == "oversized_packet_dropped" {
+		return IgnoredEvent{}
 	} else {
 		panic(fmt.Sprintf("unrecognized event type in message:%v, original: %s", mappedData, string(data)))
 	}
 }
 
+func isChangeEvent(event interface{}) bool {
+	switch event {
+	case "link_down", "link_up", "link_replaced", "node_down", "node_up", "router_replaced", "max_hops_changed",
+		"neighbor_added", "neighbor_removed", "trace_wrapped", "trace_ended":
+		return true
+	}
+	return false
+}
+
 func splitLinkLogs(combined string) []string {
 	return strings.Split(combined, ",")
 }
@@ -338,7 +865,7 @@ func combineCsvs(csvs []string, outfname string) {
 	}
 	defer outFile.Close()
 	outWriter := csv.NewWriter(outFile)
-	outWriter.Write([]string{"time", "latency", "dropped", "type"})
+	outWriter.Write([]string{"time", "latency", "dropped", "type", "event"})
 	defer outWriter.Flush()
 	for _, fname := range csvs {
 		csvFile, err := os.Open(fname)
@@ -383,6 +910,13 @@ func main() {
 	stats := Stats{
 		entryTime:        make(map[PacketId]simTime),
 		firstExitTime:    make(map[PacketId]simTime),
+		returnEntryTime:  make(map[PacketId]simTime),
+		returnExitTime:   make(map[PacketId]simTime),
+		deliveredCopies:  make(map[PacketId]int),
+		dropReason:       make(map[PacketId]string),
+		returnDropReason: make(map[PacketId]string),
+		firstRoute:       make(map[PacketId]string),
+		routeCopies:      make(map[string]int),
 		perLinkEntryTime: make(map[Link](map[PacketId]simTime)),
 		perLinkExitTime:  make(map[Link](map[PacketId]simTime)),
 		perLinkStartTime: make(map[Link]simTime),
@@ -394,11 +928,26 @@ func main() {
 	}
 
 	var allCsvs []string
-	combinedDataset := LatencyDataset{data: stats.calculateLatencies()}
+	combinedDataset := LatencyDataset{data: stats.calculateLatencies(), changes: stats.calculateChanges()}
 	combinedPath := fmt.Sprintf("%s/combined.csv", *outdir)
 	combinedDataset.toCsv(combinedPath)
 	allCsvs = append(allCsvs, combinedPath)
 
+	stats.calculateRedundancy().toCsv(fmt.Sprintf("%s/redundancy.csv", *outdir))
+	DropDataset{data: stats.calculateDrops()}.toCsv(fmt.Sprintf("%s/drops.csv", *outdir))
+	RouteDataset{data: stats.calculateRouteFrequencies()}.toCsv(fmt.Sprintf("%s/routes.csv", *outdir))
+	PathLatencyDataset{data: stats.calculatePathLatencies()}.toCsv(fmt.Sprintf("%s/path_latency.csv", *outdir))
+	ImpairmentDataset{data: stats.calculateImpairments()}.toCsv(fmt.Sprintf("%s/impairments.csv", *outdir))
+
+	if stats.linkSummary != nil {
+		stats.linkSummary.toCsv(fmt.Sprintf("%s/links.csv", *outdir))
+	}
+
+	if len(stats.returnEntryTime) > 0 {
+		returnDataset := LatencyDataset{data: stats.calculateReturnLatencies(), changes: stats.calculateChanges()}
+		returnDataset.toCsv(fmt.Sprintf("%s/return.csv", *outdir))
+	}
+
 	combinedThroughputPath := fmt.Sprintf("%s/combined_throughput.csv", *outdir)
 	combinedThroughput := ThroughputDataset{data: stats.calculateThroughput()}
 	combinedThroughput.toCsv(combinedThroughputPath)
@@ -416,6 +965,13 @@ func main() {
 		linkStats := Stats{
 			entryTime:        make(map[PacketId]simTime),
 			firstExitTime:    make(map[PacketId]simTime),
+			returnEntryTime:  make(map[PacketId]simTime),
+			returnExitTime:   make(map[PacketId]simTime),
+			deliveredCopies:  make(map[PacketId]int),
+			dropReason:       make(map[PacketId]string),
+			returnDropReason: make(map[PacketId]string),
+			firstRoute:       make(map[PacketId]string),
+			routeCopies:      make(map[string]int),
 			perLinkEntryTime: make(map[Link](map[PacketId]simTime)),
 			perLinkExitTime:  make(map[Link](map[PacketId]simTime)),
 			perLinkStartTime: make(map[Link]simTime),
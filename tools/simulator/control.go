@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	config "github.com/aditiharini/simulator-proxy/config/simulator"
+	. "github.com/aditiharini/simulator-proxy/simulation"
+	log "github.com/sirupsen/logrus"
+)
+
+// Starts serving handler in the background on a TCP address, or on a Unix
+// socket if address is "unix:" followed by the socket's path.
+func serveHTTP(address string, handler http.Handler) *http.Server {
+	network := "tcp"
+	if strings.HasPrefix(address, "unix:") {
+		network = "unix"
+		address = strings.TrimPrefix(address, "unix:")
+		// Left behind by a run that didn't shut down cleanly
+		os.Remove(address)
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		panic(err)
+	}
+	server := &http.Server{Handler: handler}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			panic(err)
+		}
+	}()
+	return server
+}
+
+// controller changes a running simulation on behalf of the control API.
+type controller struct {
+	config   config.Config
+	clock    Clock
+	sim      *BaseSimulator
+	network  *network
+	receiver *receiver
+}
+
+type linkRequest struct {
+	Src string `json:"src"`
+	Dst string `json:"dst"`
+	// The new link, in the same format as a topology entry
+	Link interface{} `json:"link"`
+}
+
+type nodeRequest struct {
+	Node string `json:"node"`
+}
+
+type maxHopsRequest struct {
+	MaxHops int `json:"maxHops"`
+}
+
+func serveControl(address string, c *controller) *http.Server {
+	server := serveHTTP(address, newControlHandler(c))
+	log.WithFields(log.Fields{
+		"event":   "serve_control",
+		"address": address,
+	}).Info()
+	return server
+}
+
+// newControlHandler serves the control API. Every request is a POST with a
+// JSON body:
+//
+//	/links/down, /links/up   {"src": "0", "dst": "base"}
+//	/links/replace           {"src": "0", "dst": "base", "link": {"type": "delay", "delay": 5}}
+//	/nodes/down, /nodes/up   {"node": "1"}
+//	/maxHops                 {"maxHops": 3}
+//	/router                  {"type": "broadcast"}
+func newControlHandler(c *controller) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/links/down", c.handle(c.linkDown))
+	mux.HandleFunc("/links/up", c.handle(c.linkUp))
+	mux.HandleFunc("/links/replace", c.handle(c.replaceLink))
+	mux.HandleFunc("/nodes/down", c.handle(c.nodeDown))
+	mux.HandleFunc("/nodes/up", c.handle(c.nodeUp))
+	mux.HandleFunc("/maxHops", c.handle(c.setMaxHops))
+	mux.HandleFunc("/router", c.handle(c.replaceRouter))
+	return mux
+}
+
+// Wraps a control function that reads its request from the body. Bad
+// requests panic while being parsed, the same way a bad configuration does,
+// so those panics are reported to the client instead.
+func (c *controller) handle(f func(body *json.Decoder) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "control requests must be POSTs", http.StatusMethodNotAllowed)
+			return
+		}
+		defer func() {
+			if err := recover(); err != nil {
+				http.Error(w, fmt.Sprint(err), http.StatusBadRequest)
+			}
+		}()
+		if err := f(json.NewDecoder(r.Body)); err == errBadRequest {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+}
+
+var errBadRequest = errors.New("malformed request")
+
+func (c *controller) readLink(body *json.Decoder) (linkRequest, Address, Address, error) {
+	var request linkRequest
+	if err := body.Decode(&request); err != nil {
+		return request, 0, 0, errBadRequest
+	}
+	src := toAddress(request.Src, c.config.General.SimulatedDstAddress)
+	dst := toAddress(request.Dst, c.config.General.SimulatedDstAddress)
+	return request, src, dst, nil
+}
+
+func (c *controller) linkDown(body *json.Decoder) error {
+	_, src, dst, err := c.readLink(body)
+	if err != nil {
+		return err
+	}
+	return c.sim.TakeLinkDown(src, dst)
+}
+
+func (c *controller) linkUp(body *json.Decoder) error {
+	_, src, dst, err := c.readLink(body)
+	if err != nil {
+		return err
+	}
+	return c.sim.BringLinkUp(src, dst)
+}
+
+func (c *controller) replaceLink(body *json.Decoder) error {
+	request, src, dst, err := c.readLink(body)
+	if err != nil {
+		return err
+	} else if request.Link == nil {
+		return errBadRequest
+	}
+	return c.sim.ReplaceLink(c.network.toLinkConfig(request.Link, src, dst))
+}
+
+func (c *controller) readNode(body *json.Decoder) (Address, error) {
+	var request nodeRequest
+	if err := body.Decode(&request); err != nil {
+		return 0, errBadRequest
+	}
+	return toAddress(request.Node, c.config.General.SimulatedDstAddress), nil
+}
+
+func (c *controller) nodeDown(body *json.Decoder) error {
+	node, err := c.readNode(body)
+	if err != nil {
+		return err
+	}
+	return c.sim.TakeNodeDown(node)
+}
+
+func (c *controller) nodeUp(body *json.Decoder) error {
+	node, err := c.readNode(body)
+	if err != nil {
+		return err
+	}
+	return c.sim.BringNodeUp(node)
+}
+
+func (c *controller) setMaxHops(body *json.Decoder) error {
+	var request maxHopsRequest
+	if err := body.Decode(&request); err != nil || request.MaxHops < 0 {
+		return errBadRequest
+	}
+	c.receiver.setMaxHops(request.MaxHops)
+	return nil
+}
+
+func (c *controller) replaceRouter(body *json.Decoder) error {
+	var routerConfig config.RouterConfig
+	if err := body.Decode(&routerConfig); err != nil {
+		return errBadRequest
+	}
+	if routerConfig.Type != "broadcast" && routerConfig.Type != "best_neighbor" {
+		return errBadRequest
+	}
+	newConfig := c.config
+	newConfig.General.RoutingAlgorithm = routerConfig
+	// Mobility tracking changes the neighbors on the clock loop, so the
+	// router is built from them there
+	c.sim.Apply(func(controls Controls) {
+		controls.ReplaceRouter(newRouter(newConfig, c.clock, c.network.neighbors))
+	})
+	return nil
+}
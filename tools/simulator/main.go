@@ -3,16 +3,24 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"os/exec"
+	"os/signal"
+	"sort"
 	"strconv"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	config "github.com/aditiharini/simulator-proxy/config/simulator"
 	. "github.com/aditiharini/simulator-proxy/simulation"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 	log "github.com/sirupsen/logrus"
 	"github.com/songgao/water"
 )
@@ -34,57 +42,485 @@ func readConfig(filename string) config.Config {
 // TODO(aditi) : Make this config parsing cleaner
 // It would be nice to automatically read into structs
 // instead of manually doing casting work
-func toLinkConfigs(rawTopology config.TopologyJson, simulatedDstAddress Address) []LinkConfig {
-	var linkConfigs []LinkConfig
-	for strSrc, linksByDst := range rawTopology {
-		src, err := strconv.Atoi(strSrc)
-		if err != nil {
-			panic(err)
+func toAddress(strAddr string, simulatedDstAddress Address) Address {
+	if strAddr == "base" {
+		return simulatedDstAddress
+	}
+	addr, err := strconv.Atoi(strAddr)
+	if err != nil {
+		panic(err)
+	}
+	return addr
+}
+
+// Reads a link's optional "queue" entry. Times are in milliseconds.
+func toQueueConfig(rawQueue interface{}) QueueConfig {
+	if rawQueue == nil {
+		return QueueConfig{}
+	}
+	queueMap := rawQueue.(map[string]interface{})
+	number := func(key string) float64 {
+		if value, ok := queueMap[key]; ok {
+			return value.(float64)
 		}
-		for strDst, linkInfo := range linksByDst {
-			var dst Address
-			if strDst == "base" {
-				dst = simulatedDstAddress
-			} else {
-				dst, err = strconv.Atoi(strDst)
-				if err != nil {
-					panic(err)
-				}
-			}
+		return 0
+	}
+	queueType, _ := queueMap["type"].(string)
+	return QueueConfig{
+		Type:           queueType,
+		Limit:          int(number("limit")),
+		MinThreshold:   number("minThreshold"),
+		MaxThreshold:   number("maxThreshold"),
+		MaxProbability: number("maxProbability"),
+		Weight:         number("weight"),
+		Target:         time.Duration(number("target") * float64(time.Millisecond)),
+		Interval:       time.Duration(number("interval") * float64(time.Millisecond)),
+	}
+}
 
-			var newLinkConfig LinkConfig
-			linkInfoMap := linkInfo.(map[string]interface{})
-			if linkInfoMap["type"] == "delay" {
-				newLinkConfig = NewDelayLinkConfig(
-					time.Millisecond*time.Duration(linkInfoMap["delay"].(float64)),
-					src,
-					dst,
-				)
-			} else if linkInfoMap["type"] == "trace" {
-				newLinkConfig = NewTraceLinkConfig(
-					linkInfoMap["file"].(string),
-					linkInfoMap["loss"].(string),
-					src,
-					dst,
-				)
-			} else {
-				panic("unsupported link type provided")
+// A delay is either a number of milliseconds or a distribution to draw
+// each packet's delay from, with its parameters in milliseconds.
+func toDelayDistribution(rawDelay interface{}) DelayDistribution {
+	if delay, ok := rawDelay.(float64); ok {
+		return ConstantDelay(time.Millisecond * time.Duration(delay))
+	}
+	delayMap := rawDelay.(map[string]interface{})
+	millis := func(key string) time.Duration {
+		value, ok := delayMap[key].(float64)
+		if !ok {
+			panic(fmt.Sprintf("%v delay needs %q", delayMap["type"], key))
+		}
+		return time.Duration(value * float64(time.Millisecond))
+	}
+	switch delayMap["type"] {
+	case "normal":
+		return NormalDelay{Mean: millis("mean"), StdDev: millis("stddev")}
+	case "lognormal":
+		return LogNormalDelay{Mean: millis("mean"), StdDev: millis("stddev")}
+	case "pareto":
+		return ParetoDelay{Scale: millis("scale"), Shape: delayMap["shape"].(float64)}
+	case "uniform":
+		return UniformDelay{Min: millis("min"), Max: millis("max")}
+	case "empirical":
+		return LoadEmpiricalDelay(delayMap["file"].(string))
+	}
+	panic("unsupported delay distribution provided")
+}
+
+// A link's loss is either the name of a loss trace or a loss model.
+func toLossConfig(rawLoss interface{}) LossConfig {
+	if rawLoss == nil {
+		return LossConfig{}
+	} else if file, ok := rawLoss.(string); ok {
+		return LossConfig{Type: "trace", File: file}
+	}
+	lossMap := rawLoss.(map[string]interface{})
+	number := func(key string) float64 {
+		if value, ok := lossMap[key]; ok {
+			return value.(float64)
+		}
+		return 0
+	}
+	lossType, _ := lossMap["type"].(string)
+	file, _ := lossMap["file"].(string)
+	loss := LossConfig{
+		Type:     lossType,
+		File:     file,
+		P:        number("p"),
+		R:        number("r"),
+		GoodLoss: number("goodLoss"),
+		BadLoss:  number("badLoss"),
+	}
+	if states, ok := lossMap["states"].([]interface{}); ok {
+		for _, state := range states {
+			loss.States = append(loss.States, state.(float64))
+		}
+	}
+	if transitions, ok := lossMap["transitions"].([]interface{}); ok {
+		for _, rawRow := range transitions {
+			var row []float64
+			for _, probability := range rawRow.([]interface{}) {
+				row = append(row, probability.(float64))
 			}
-			linkConfigs = append(linkConfigs, newLinkConfig)
+			loss.Transitions = append(loss.Transitions, row)
 		}
 	}
-	return linkConfigs
+	return loss
 }
 
-func Start(config config.Config, ctx context.Context) {
-	// Run sudo sysctl -w net.ipv6.conf.default.accept_ra=0 before
-	// starting any mahimahi instances or simulator.
-	// This will stop router advertisement messages.
-	log.SetFormatter(&log.JSONFormatter{
-		TimestampFormat: time.StampMicro,
+// A pipeline lists its stages in order. Stages are entries of the kinds
+// links are, along with "loss", "jitter" and "impairments" stages, and take
+// the pipeline's queue as the first stage's.
+func (n *network) toPipelineLinkConfig(linkInfoMap map[string]interface{}, src Address, dst Address) LinkConfig {
+	var stages []PipelineStage
+	for i, rawStage := range linkInfoMap["stages"].([]interface{}) {
+		stageMap := make(map[string]interface{})
+		for key, value := range rawStage.(map[string]interface{}) {
+			stageMap[key] = value
+		}
+		delete(stageMap, "queue")
+		if i == 0 && linkInfoMap["queue"] != nil {
+			stageMap["queue"] = linkInfoMap["queue"]
+		}
+		stageType, _ := stageMap["type"].(string)
+		name, ok := stageMap["name"].(string)
+		if !ok {
+			name = fmt.Sprintf("%d:%s", i, stageType)
+		}
+
+		stage := PipelineStage{Name: name}
+		switch stageType {
+		case "impairments":
+			stage.Impairments = toImpairmentConfig(stageMap)
+		case "loss":
+			stage.Link = NewRandomDelayLinkConfig(ConstantDelay(0), false, toLossConfig(stageMap["loss"]), toQueueConfig(stageMap["queue"]), src, dst)
+		case "jitter":
+			stageMap["type"] = "delay"
+			stage.Link = n.toLinkConfig(stageMap, src, dst)
+		case "pipeline":
+			panic("pipeline stages can't be pipelines themselves")
+		default:
+			stage.Link = n.toLinkConfig(stageMap, src, dst)
+		}
+		stages = append(stages, stage)
+	}
+	return NewPipelineLinkConfig(stages, src, dst)
+}
+
+func toImpairmentConfig(rawImpairments interface{}) ImpairmentConfig {
+	impairmentMap := rawImpairments.(map[string]interface{})
+	number := func(key string) float64 {
+		if value, ok := impairmentMap[key]; ok {
+			return value.(float64)
+		}
+		return 0
+	}
+	fixChecksums, _ := impairmentMap["fixChecksums"].(bool)
+	return ImpairmentConfig{
+		Reorder:       number("reorder"),
+		ReorderWindow: int(number("reorderWindow")),
+		Duplicate:     number("duplicate"),
+		Corrupt:       number("corrupt"),
+		FixChecksums:  fixChecksums,
+	}
+}
+
+// network is what the simulator's links and routers are built from, kept to
+// build replacement links and routers mid-run.
+type network struct {
+	simulatedDst Address
+	mobility     *Mobility
+	// Shared by the routers on the path to the base, and kept up to date as
+	// drones move in and out of range
+	neighbors NeighborMap
+	// The links on the path to the base, and on the path back from it
+	links       []LinkConfig
+	returnLinks []LinkConfig
+}
+
+// Places the nodes in the mobility section, if there is one, timed from epoch.
+func newMobility(config config.Config, epoch time.Time) *Mobility {
+	if config.Mobility == nil {
+		return nil
+	}
+	trajectories := make(map[Address]Trajectory)
+	for strNode, filename := range config.Mobility.Trajectories {
+		trajectories[toAddress(strNode, config.General.SimulatedDstAddress)] = LoadTrajectory(filename)
+	}
+	model := config.Mobility.Model
+	return NewMobility(epoch, trajectories, PropagationModel{
+		Type:              model.Type,
+		Frequency:         model.Frequency,
+		ReferenceDistance: model.ReferenceDistance,
+		ReferenceLoss:     model.ReferenceLoss,
+		Exponent:          model.Exponent,
+		TxPower:           model.TxPower,
+		NoiseFloor:        model.NoiseFloor,
+		Bandwidth:         model.Bandwidth,
+		MaxRate:           model.MaxRate,
+		Range:             model.Range,
 	})
-	log.SetOutput(os.Stdout)
+}
+
+// Builds the link from src to dst described by a topology entry, with any
+// impairments it lists.
+func (n *network) toLinkConfig(linkInfo interface{}, src Address, dst Address) LinkConfig {
+	link := n.toBaseLinkConfig(linkInfo, src, dst)
+	if rawImpairments, ok := linkInfo.(map[string]interface{})["impairments"]; ok {
+		return NewImpairedLinkConfig(link, toImpairmentConfig(rawImpairments))
+	}
+	return link
+}
+
+func (n *network) toBaseLinkConfig(linkInfo interface{}, src Address, dst Address) LinkConfig {
+	linkInfoMap := linkInfo.(map[string]interface{})
+	if linkInfoMap["type"] == "delay" {
+		reorder, _ := linkInfoMap["reorder"].(bool)
+		return NewRandomDelayLinkConfig(
+			toDelayDistribution(linkInfoMap["delay"]),
+			reorder,
+			toLossConfig(linkInfoMap["loss"]),
+			toQueueConfig(linkInfoMap["queue"]),
+			src,
+			dst,
+		)
+	} else if linkInfoMap["type"] == "delay_trace" {
+		interpolate, _ := linkInfoMap["interpolate"].(bool)
+		reorder, _ := linkInfoMap["reorder"].(bool)
+		return NewDelayTraceLinkConfig(
+			linkInfoMap["file"].(string),
+			interpolate,
+			reorder,
+			toLossConfig(linkInfoMap["loss"]),
+			toQueueConfig(linkInfoMap["queue"]),
+			src,
+			dst,
+		)
+	} else if linkInfoMap["type"] == "rate" {
+		burst := 0.0
+		if linkInfoMap["burst"] != nil {
+			burst = linkInfoMap["burst"].(float64)
+		}
+		// Without a delay, packets arrive as soon as they are sent
+		delay, _ := linkInfoMap["delay"].(float64)
+		return NewRateLinkConfig(
+			linkInfoMap["rate"].(float64),
+			int(burst),
+			time.Duration(delay*float64(time.Millisecond)),
+			toQueueConfig(linkInfoMap["queue"]),
+			src,
+			dst,
+		)
+	} else if linkInfoMap["type"] == "trace" {
+		opportunityBytes, _ := linkInfoMap["opportunityBytes"].(float64)
+		endPolicy, _ := linkInfoMap["endPolicy"].(string)
+		// A start offset is in milliseconds, or "random" to draw one
+		startOffset, _ := linkInfoMap["startOffset"].(float64)
+		return NewTraceLinkConfig(
+			linkInfoMap["file"].(string),
+			int(opportunityBytes),
+			endPolicy,
+			time.Duration(startOffset*float64(time.Millisecond)),
+			linkInfoMap["startOffset"] == "random",
+			toLossConfig(linkInfoMap["loss"]),
+			toQueueConfig(linkInfoMap["queue"]),
+			src,
+			dst,
+		)
+	} else if linkInfoMap["type"] == "pipeline" {
+		return n.toPipelineLinkConfig(linkInfoMap, src, dst)
+	} else if linkInfoMap["type"] == "mobile" {
+		if n.mobility == nil {
+			panic("mobile links need a mobility section")
+		}
+		return NewMobileLinkConfig(n.mobility, toQueueConfig(linkInfoMap["queue"]), src, dst)
+	}
+	panic("unsupported link type provided")
+}
+
+func (n *network) toLinkConfigs(rawTopology config.TopologyJson) []LinkConfig {
+	var linkConfigs []LinkConfig
+	for strSrc, linksByDst := range rawTopology {
+		src := toAddress(strSrc, n.simulatedDst)
+		for strDst, linkInfo := range linksByDst {
+			dst := toAddress(strDst, n.simulatedDst)
+			linkConfigs = append(linkConfigs, n.toLinkConfig(linkInfo, src, dst))
+		}
+	}
+	// Map iteration order is random, but runs need to build links and
+	// neighbor lists in the same order to be reproducible
+	sort.Slice(linkConfigs, func(i, j int) bool {
+		if linkConfigs[i].SrcAddr() == linkConfigs[j].SrcAddr() {
+			return linkConfigs[i].DstAddr() < linkConfigs[j].DstAddr()
+		}
+		return linkConfigs[i].SrcAddr() < linkConfigs[j].SrcAddr()
+	})
+	return linkConfigs
+}
+
+func newRouter(config config.Config, clock Clock, neighborMap NeighborMap) RoutingSimulator {
+	var router RoutingSimulator
+	if config.General.RoutingAlgorithm.Type == "broadcast" {
+		router = NewBroadcastSimulator(neighborMap)
+	} else if config.General.RoutingAlgorithm.Type == "best_neighbor" {
+		router = NewBestNeighborSimulator(clock, neighborMap, config.General.SimulatedDstAddress, time.Millisecond*time.Duration(config.General.RoutingAlgorithm.UpdateLag))
+	} else {
+		panic("No valid routing set")
+	}
+	return avoidLoops(config, router)
+}
+
+func avoidLoops(config config.Config, router RoutingSimulator) RoutingSimulator {
+	if config.General.RoutingAlgorithm.AvoidLoops {
+		return NewLoopFreeRouter(router)
+	}
+	return router
+}
+
+func startSimulator(config config.Config, clock Clock, sink PacketSink) (*BaseSimulator, *network) {
+	sim, n := newSimulator(config, clock, sink)
+	sim.Start(context.Background(), n.links, config.General.MaxQueueLength)
+	return sim, n
+}
+
+// Sets up everything startSimulator does without starting the clock loop, so
+// callbacks can be scheduled on a virtual clock before it starts running.
+func newSimulator(config config.Config, clock Clock, sink PacketSink) (*BaseSimulator, *network) {
+	sim := NewSimulator(clock, config.General.SimulatedDstAddress, sink, net.ParseIP(config.General.DevDstAddr))
+	n := &network{simulatedDst: config.General.SimulatedDstAddress, mobility: newMobility(config, clock.Now())}
+	linkConfigs := n.toLinkConfigs(config.Topology)
+	n.links = linkConfigs
+
+	n.neighbors = ToNeighborsMap(linkConfigs)
+
+	// Start all link emulation and start receiving/sending packets
+	if config.General.DevDstAddr6 != "" {
+		sim.SetIPv6Address(net.ParseIP(config.General.DevDstAddr6))
+	}
+	sim.SetRouter(newRouter(config, clock, n.neighbors))
+	if len(config.ReverseTopology) > 0 {
+		reverseLinkConfigs := n.toLinkConfigs(config.ReverseTopology)
+		n.returnLinks = reverseLinkConfigs
+		reverseNeighbors := ToNeighborsMap(reverseLinkConfigs)
+		sim.SetReturnLinks(reverseLinkConfigs, avoidLoops(config, NewBroadcastSimulator(reverseNeighbors)))
+		sim.SetDefaultReturnRoute(config.General.SimulatedSrcAddress, net.ParseIP(config.General.RealSrcAddress))
+		if n.mobility != nil {
+			n.mobility.Track(clock, reverseNeighbors, reverseLinkConfigs, updateInterval(config))
+		}
+	}
+	if n.mobility != nil {
+		n.mobility.Track(clock, n.neighbors, linkConfigs, updateInterval(config))
+	}
+	sim.SetSeed(config.General.Seed)
+	sim.SetDuplicateWindow(config.General.DuplicateWindow)
+	return &sim, n
+}
+
+func updateInterval(config config.Config) time.Duration {
+	if config.Mobility.UpdateInterval == 0 {
+		return 100 * time.Millisecond
+	}
+	return time.Millisecond * time.Duration(config.Mobility.UpdateInterval)
+}
+
+func toFlowRules(rules []config.ClassifierRule) []FlowRule {
+	var flowRules []FlowRule
+	for _, rule := range rules {
+		flowRule := FlowRule{
+			SrcPort: uint16(rule.SrcPort),
+			DstPort: uint16(rule.DstPort),
+			DSCP:    AnyDSCP,
+			Node:    rule.SimulatedSrc,
+		}
+		if rule.SrcAddress != "" {
+			flowRule.SrcAddr = net.ParseIP(rule.SrcAddress)
+		}
+		if rule.Protocol == "udp" {
+			flowRule.Protocol = layers.IPProtocolUDP
+		} else if rule.Protocol == "tcp" {
+			flowRule.Protocol = layers.IPProtocolTCP
+		} else if rule.Protocol == "icmp" {
+			flowRule.Protocol = layers.IPProtocolICMPv4
+		} else if rule.Protocol == "icmpv6" {
+			flowRule.Protocol = layers.IPProtocolICMPv6
+		} else if rule.Protocol != "" {
+			panic("unsupported classifier protocol provided")
+		}
+		if rule.DSCP != nil {
+			flowRule.DSCP = *rule.DSCP
+		}
+		flowRules = append(flowRules, flowRule)
+	}
+	return flowRules
+}
+
+// Hands packets read from the source to the simulator
+type receiver struct {
+	config       config.Config
+	clock        Clock
+	sim          *BaseSimulator
+	classifier   *FlowClassifier
+	nextId       int
+	nextReturnId int
+	// Read and written atomically, since the control API can change it
+	maxHops int64
+}
+
+func newReceiver(config config.Config, clock Clock, sim *BaseSimulator) *receiver {
+	return &receiver{
+		config:     config,
+		clock:      clock,
+		sim:        sim,
+		classifier: NewFlowClassifier(toFlowRules(config.General.Classifier), config.General.SimulatedSrcAddress),
+		maxHops:    int64(config.General.MaxHops),
+	}
+}
+
+// Sets the hops packets received from now on can take.
+func (r *receiver) setMaxHops(maxHops int) {
+	atomic.StoreInt64(&r.maxHops, int64(maxHops))
+	log.WithFields(log.Fields{
+		"event":    "max_hops_changed",
+		"max_hops": maxHops,
+	}).WithTime(r.clock.Now()).Info()
+}
+
+// Return traffic is addressed to the address the simulator rewrites sources to
+func (r *receiver) isReturnPacket(packetData []byte) bool {
+	if len(r.config.ReverseTopology) == 0 {
+		return false
+	}
+	if len(packetData) > 0 && packetData[0]>>4 == 6 {
+		decodedPacket := gopacket.NewPacket(packetData, layers.LayerTypeIPv6, gopacket.Default)
+		if ipLayer := decodedPacket.Layer(layers.LayerTypeIPv6); ipLayer != nil {
+			return ipLayer.(*layers.IPv6).DstIP.Equal(net.ParseIP(r.config.General.DevDstAddr6))
+		}
+		return false
+	}
+	decodedPacket := gopacket.NewPacket(packetData, layers.LayerTypeIPv4, gopacket.Default)
+	if ipLayer := decodedPacket.Layer(layers.LayerTypeIPv4); ipLayer != nil {
+		return ipLayer.(*layers.IPv4).DstIP.Equal(net.ParseIP(r.config.General.DevDstAddr))
+	}
+	return false
+}
+
+func (r *receiver) receive(packetData []byte) {
+	if r.isReturnPacket(packetData) {
+		log.WithFields(log.Fields{
+			"event": "return_packet_received",
+			"id":    r.nextReturnId,
+		}).WithTime(r.clock.Now()).Info()
+
+		packet := DataPacket{
+			HopsLeft:    int(atomic.LoadInt64(&r.maxHops)),
+			Data:        packetData,
+			ArrivalTime: r.clock.Now(),
+			Id:          r.nextReturnId,
+		}
+		r.nextReturnId++
+		r.sim.WriteReturnPacket(&packet)
+		return
+	}
 
+	src := r.classifier.Classify(packetData)
+	log.WithFields(log.Fields{
+		"event": "packet_received",
+		"id":    r.nextId,
+		"src":   src,
+	}).WithTime(r.clock.Now()).Info()
+
+	packet := DataPacket{
+		Src:         src,
+		HopsLeft:    int(atomic.LoadInt64(&r.maxHops)),
+		Data:        packetData,
+		ArrivalTime: r.clock.Now(),
+		Id:          r.nextId,
+	}
+	r.nextId++
+	r.sim.WriteNewPacket(&packet, packet.Src)
+}
+
+func setupTun(config config.Config) *water.Interface {
 	devConfig := water.Config{
 		DeviceType: water.TUN,
 	}
@@ -95,19 +531,41 @@ func Start(config config.Config, ctx context.Context) {
 		panic(err)
 	}
 
-	exec.Command("ip", "rule", "delete", "table", config.General.RoutingTableNum).Run()
+	// Clear out rules left behind by earlier runs
+	for exec.Command("ip", "rule", "delete", "table", config.General.RoutingTableNum).Run() == nil {
+	}
+	for exec.Command("ip", "-6", "rule", "delete", "table", config.General.RoutingTableNum).Run() == nil {
+	}
 
 	if err := exec.Command("ip", "link", "set", "dev", dev.Name(), "up").Run(); err != nil {
 		fmt.Println("Cmd: ", "ip link set dev", dev.Name(), "up")
 		panic(err)
 	}
+	if config.General.DevMTU != 0 {
+		mtu := strconv.Itoa(config.General.DevMTU)
+		if err := exec.Command("ip", "link", "set", "dev", dev.Name(), "mtu", mtu).Run(); err != nil {
+			fmt.Println("Cmd: ", "ip link set dev", dev.Name(), "mtu", mtu)
+			panic(err)
+		}
+	}
 	if err := exec.Command("ip", "addr", "add", config.General.DevSrcAddr, "dev", dev.Name()).Run(); err != nil {
 		fmt.Println("Cmd: ", "ip addr add", config.General.DevSrcAddr, "dev", dev.Name())
 		panic(err)
 	}
-	if err := exec.Command("ip", "rule", "add", "from", config.General.RealSrcAddress, "table", config.General.RoutingTableNum).Run(); err != nil {
-		fmt.Println("Cmd: ", "ip rule add from", config.General.RealSrcAddress, "table", config.General.RoutingTableNum)
-		panic(err)
+	// Every application acting as a drone needs its traffic sent through the device
+	realSrcAddresses := []string{config.General.RealSrcAddress}
+	seen := map[string]bool{config.General.RealSrcAddress: true}
+	for _, rule := range config.General.Classifier {
+		if rule.SrcAddress != "" && !seen[rule.SrcAddress] {
+			realSrcAddresses = append(realSrcAddresses, rule.SrcAddress)
+			seen[rule.SrcAddress] = true
+		}
+	}
+	for _, realSrcAddress := range realSrcAddresses {
+		if err := exec.Command("ip", "rule", "add", "from", realSrcAddress, "table", config.General.RoutingTableNum).Run(); err != nil {
+			fmt.Println("Cmd: ", "ip rule add from", realSrcAddress, "table", config.General.RoutingTableNum)
+			panic(err)
+		}
 	}
 	if err := exec.Command("ifconfig", dev.Name(), config.General.DevSrcAddr, "dstaddr", config.General.DevDstAddr).Run(); err != nil {
 		fmt.Println("Cmd: ", "ifconfig", dev.Name(), config.General.DevSrcAddr, "dstaddr", config.General.DevDstAddr)
@@ -117,51 +575,158 @@ func Start(config config.Config, ctx context.Context) {
 		fmt.Println("Cmd: ", "ip route add default dev", dev.Name(), "table", config.General.RoutingTableNum)
 		panic(err)
 	}
+	if config.General.DevSrcAddr6 != "" {
+		if err := exec.Command("ip", "-6", "addr", "add", config.General.DevSrcAddr6, "peer", config.General.DevDstAddr6, "dev", dev.Name()).Run(); err != nil {
+			fmt.Println("Cmd: ", "ip -6 addr add", config.General.DevSrcAddr6, "peer", config.General.DevDstAddr6, "dev", dev.Name())
+			panic(err)
+		}
+		if err := exec.Command("ip", "-6", "route", "add", "default", "dev", dev.Name(), "table", config.General.RoutingTableNum).Run(); err != nil {
+			fmt.Println("Cmd: ", "ip -6 route add default dev", dev.Name(), "table", config.General.RoutingTableNum)
+			panic(err)
+		}
+	}
+	return dev
+}
 
-	sim := NewSimulator(config.General.SimulatedDstAddress, dev, net.ParseIP(config.General.DevDstAddr))
-	linkConfigs := toLinkConfigs(config.Topology, config.General.SimulatedDstAddress)
+func newSource(config config.Config) PacketSource {
+	switch config.General.Source.Type {
+	case "", "tun":
+		return NewTunDevice(setupTun(config), config.General.DevMTU)
+	case "pcap":
+		return NewPcapSource(config.General.Source.File)
+	case "udp":
+		return NewUDPSource(config.General.Source.Address)
+	default:
+		panic("unsupported packet source type provided")
+	}
+}
 
-	neighborMap := ToNeighborsMap(linkConfigs)
+func newSink(config config.Config, source PacketSource) PacketSink {
+	if _, ok := source.(*PcapSource); ok && config.General.Sink.Type == "" {
+		// A TUN device would need root, which replaying a capture doesn't
+		panic("a pcap source needs a sink to be set")
+	}
+	switch config.General.Sink.Type {
+	case "", "tun":
+		// Packets go back out on the device they came in on
+		if tun, ok := source.(*TunDevice); ok {
+			return tun
+		}
+		return NewTunDevice(setupTun(config), config.General.DevMTU)
+	case "pcap":
+		return NewPcapSink(config.General.Sink.File)
+	case "udp":
+		return NewUDPSink(config.General.Sink.Address)
+	default:
+		panic("unsupported packet sink type provided")
+	}
+}
 
-	// Start all link emulation and start receiving/sending packets
-	if config.General.RoutingAlgorithm.Type == "broadcast" {
-		sim.SetRouter(NewBroadcastSimulator(neighborMap))
-	} else if config.General.RoutingAlgorithm.Type == "best_neighbor" {
-		sim.SetRouter(NewBestNeighborSimulator(neighborMap, config.General.SimulatedDstAddress, time.Millisecond*time.Duration(config.General.RoutingAlgorithm.UpdateLag)))
-	} else {
-		panic("No valid routing set")
+// Replays a capture through the simulator on a virtual clock, so the run
+// takes as long as the computation does rather than as long as the capture.
+func replay(config config.Config, source PacketSource) {
+	packetData, timestamp, err := source.ReadPacket()
+	if err == io.EOF {
+		return
+	} else if err != nil {
+		panic(err)
 	}
-	sim.Start(linkConfigs, config.General.MaxQueueLength)
 
-	id := 0
-	for {
-		select {
-		case <-ctx.Done():
-			dev.Close()
-			return
-		default:
-			packetBuf := make([]byte, 2000)
-			n, err := dev.Read(packetBuf)
-			if err != nil {
+	clock := NewVirtualClock(timestamp)
+	sink := newSink(config, source)
+	defer sink.Close()
+	sim, n := newSimulator(config, clock, sink)
+
+	// Everything is scheduled before the clock loop starts, as otherwise the
+	// loop could already have moved past the times it is scheduled for.
+	// Only keep one packet from the capture in memory at a time.
+	r := newReceiver(config, clock, sim)
+	scheduleEvents(config, clock, sim, n, r, clock.Now())
+	exhausted := make(chan struct{})
+	var scheduleReceive func(packetData []byte, timestamp time.Time)
+	scheduleReceive = func(packetData []byte, timestamp time.Time) {
+		clock.At(timestamp, func() {
+			r.receive(packetData)
+			nextData, nextTimestamp, err := source.ReadPacket()
+			if err == io.EOF {
+				close(exhausted)
+				return
+			} else if err != nil {
 				panic(err)
 			}
-			log.WithFields(log.Fields{
-				"event": "packet_received",
-				"id":    id,
-			}).Info()
-			packetData := packetBuf[:n]
-
-			packet := DataPacket{
-				Src:         config.General.SimulatedSrcAddress,
-				HopsLeft:    config.General.MaxHops,
-				Data:        packetData,
-				ArrivalTime: time.Now(),
-				Id:          id,
+			scheduleReceive(nextData, nextTimestamp)
+		})
+	}
+	scheduleReceive(packetData, timestamp)
+	sim.Start(context.Background(), n.links, config.General.MaxQueueLength)
+	if config.General.MetricsAddress != "" {
+		defer stopServer(serveMetrics(config.General.MetricsAddress, sim))
+	}
+	<-exhausted
+	// Every packet in the capture gets delivered or dropped
+	sim.Stop(context.Background())
+}
+
+func Start(config config.Config, ctx context.Context) {
+	// Run sudo sysctl -w net.ipv6.conf.default.accept_ra=0 before
+	// starting any mahimahi instances or simulator.
+	// This will stop router advertisement messages.
+	log.SetFormatter(&log.JSONFormatter{
+		TimestampFormat: time.StampMicro,
+	})
+	log.SetOutput(os.Stdout)
+
+	source := newSource(config)
+	defer source.Close()
+
+	// Captures are replayed as fast as possible rather than in real time
+	if config.General.Source.Type == "pcap" {
+		replay(config, source)
+		return
+	}
+
+	clock := NewRealClock()
+	sink := newSink(config, source)
+	defer sink.Close()
+	sim, n := startSimulator(config, clock, sink)
+	if config.General.MetricsAddress != "" {
+		defer stopServer(serveMetrics(config.General.MetricsAddress, sim))
+	}
+
+	r := newReceiver(config, clock, sim)
+	scheduleEvents(config, clock, sim, n, r, clock.Now())
+	if config.General.ControlAddress != "" {
+		defer stopServer(serveControl(config.General.ControlAddress, &controller{config: config, clock: clock, sim: sim, network: n, receiver: r}))
+	}
+	readerDone := make(chan struct{})
+	go func() {
+		defer close(readerDone)
+		for {
+			packetData, _, err := source.ReadPacket()
+			if ctx.Err() != nil {
+				// The run is over, so the source is being closed
+				return
+			} else if errors.Is(err, ErrPacketTooLarge) {
+				// Only this packet is lost, so carry on with the rest
+				log.WithFields(log.Fields{
+					"event": "oversized_packet_dropped",
+					"error": err.Error(),
+				}).WithTime(clock.Now()).Info()
+				continue
+			} else if err != nil {
+				panic(err)
 			}
-			id++
-			sim.WriteNewPacket(&packet, packet.Src)
+			r.receive(packetData)
 		}
-	}
+	}()
+
+	<-ctx.Done()
+	drainCtx, cancel := context.WithTimeout(context.Background(), time.Millisecond*time.Duration(config.General.DrainTime))
+	sim.Stop(drainCtx)
+	cancel()
+	// Unblocks the reader, which can't be stopped any other way
+	source.Close()
+	<-readerDone
 }
 
 func main() {
@@ -169,10 +734,20 @@ func main() {
 	// starting any mahimahi instances or simulator.
 	// This will stop router advertisement messages.
 	configFile := flag.String("config", "../../config/simulator/default.json", "some global configuration params")
-	runTime := flag.Int("time", 20, "Time to run sim for in seconds")
+	runTime := flag.Int("time", 20, "Time to run sim for in seconds (ignored when replaying a pcap)")
 	flag.Parse()
 	config := readConfig(*configFile)
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(*runTime))
+	// Interrupting the simulator ends the run early rather than killing it
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-signals:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
 	Start(config, ctx)
 	cancel()
 }
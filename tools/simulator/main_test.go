@@ -4,12 +4,24 @@ import (
 	"bufio"
 	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"testing"
 	"time"
 
 	config "github.com/aditiharini/simulator-proxy/config/simulator"
+	"github.com/aditiharini/simulator-proxy/simulation"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
 )
 
 var topology = map[string]map[string]interface{}{
@@ -152,3 +164,471 @@ func TestBroadcast(t *testing.T) {
 func TestBestNeighbor(t *testing.T) {
 	RunTest(config.RouterConfig{Type: "best_neighbor", UpdateLag: 100.})
 }
+
+func udpPacket(t *testing.T, payload string) []byte {
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.ParseIP("100.64.0.4"),
+		DstIP:    net.ParseIP("100.64.0.2"),
+	}
+	udp := &layers.UDP{SrcPort: 5000, DstPort: 5001}
+	udp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(
+		buf,
+		gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true},
+		ip,
+		udp,
+		gopacket.Payload([]byte(payload)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func writeInputPcap(t *testing.T, filename string, start time.Time, count int) {
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	writer := pcapgo.NewWriter(file)
+	if err := writer.WriteFileHeader(65536, layers.LinkTypeRaw); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < count; i++ {
+		data := udpPacket(t, fmt.Sprintf("packet %d", i))
+		info := gopacket.CaptureInfo{
+			Timestamp:     start.Add(time.Duration(i) * 100 * time.Millisecond),
+			CaptureLength: len(data),
+			Length:        len(data),
+		}
+		if err := writer.WritePacket(info, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Doesn't need root or Mahimahi
+func TestOfflinePcap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simulator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	start := time.Unix(1600000000, 0)
+	inputPcap := filepath.Join(dir, "in.pcap")
+	outputPcap := filepath.Join(dir, "out.pcap")
+	writeInputPcap(t, inputPcap, start, 3)
+
+	offlineGeneral := general
+	offlineGeneral.RoutingAlgorithm = config.RouterConfig{Type: "broadcast"}
+	offlineGeneral.Source = config.Endpoint{Type: "pcap", File: inputPcap}
+	offlineGeneral.Sink = config.Endpoint{Type: "pcap", File: outputPcap}
+	simConfig := config.Config{
+		Topology: map[string]map[string]interface{}{
+			"0": {
+				"1":    map[string]interface{}{"type": "delay", "delay": 1.},
+				"base": map[string]interface{}{"type": "delay", "delay": 5.},
+			},
+			"1": {
+				"base": map[string]interface{}{"type": "delay", "delay": 5.},
+			},
+		},
+		General: offlineGeneral,
+	}
+	Start(simConfig, context.Background())
+
+	reader := simulation.NewPcapSource(outputPcap)
+	defer reader.Close()
+	var offsets []time.Duration
+	for {
+		data, timestamp, err := reader.ReadPacket()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		ip := gopacket.NewPacket(data, layers.LayerTypeIPv4, gopacket.Default).Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		if !ip.SrcIP.Equal(net.ParseIP(offlineGeneral.DevDstAddr)) {
+			t.Fatalf("source address not rewritten: %v", ip.SrcIP)
+		}
+		offsets = append(offsets, timestamp.Sub(start))
+	}
+
+	// Every packet reaches the base directly and through drone 1
+	expected := []time.Duration{5, 6, 105, 106, 205, 206}
+	if len(offsets) != len(expected) {
+		t.Fatalf("expected %d packets, got %d", len(expected), len(offsets))
+	}
+	for i := range expected {
+		if offsets[i] != expected[i]*time.Millisecond {
+			t.Fatalf("packet %d delivered at %v, expected %v", i, offsets[i], expected[i]*time.Millisecond)
+		}
+	}
+}
+
+// Mobility keeps checking the drones' positions for as long as anything else
+// is going on, which mustn't move the replay's time along on its own
+func TestOfflinePcapWithMobilityIsReproducible(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simulator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	start := time.Unix(1600000000, 0)
+	inputPcap := filepath.Join(dir, "in.pcap")
+	writeInputPcap(t, inputPcap, start, 3)
+	fixed := filepath.Join(dir, "fixed.txt")
+	distant := filepath.Join(dir, "distant.txt")
+	if err := ioutil.WriteFile(fixed, []byte("0 0 0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(distant, []byte("0 2000 0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var first []byte
+	for run := 0; run < 20; run++ {
+		outputPcap := filepath.Join(dir, fmt.Sprintf("out-%d.pcap", run))
+		offlineGeneral := general
+		offlineGeneral.RoutingAlgorithm = config.RouterConfig{Type: "broadcast"}
+		offlineGeneral.Source = config.Endpoint{Type: "pcap", File: inputPcap}
+		offlineGeneral.Sink = config.Endpoint{Type: "pcap", File: outputPcap}
+		simConfig := config.Config{
+			Topology: map[string]map[string]interface{}{
+				"0": {
+					"1":    map[string]interface{}{"type": "mobile"},
+					"base": map[string]interface{}{"type": "delay", "delay": 5.},
+				},
+				"1": {
+					"base": map[string]interface{}{"type": "delay", "delay": 5.},
+				},
+			},
+			General: offlineGeneral,
+			Mobility: &config.MobilityConfig{
+				Trajectories:   map[string]string{"0": fixed, "1": distant},
+				Model:          config.PropagationConfig{Range: 1000},
+				UpdateInterval: 1,
+			},
+		}
+		Start(simConfig, context.Background())
+
+		output, err := ioutil.ReadFile(outputPcap)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if run == 0 {
+			first = output
+		} else if string(output) != string(first) {
+			t.Fatalf("run %d delivered differently from the first", run)
+		}
+	}
+
+	reader := simulation.NewPcapSource(filepath.Join(dir, "out-0.pcap"))
+	defer reader.Close()
+	var offsets []time.Duration
+	for {
+		_, timestamp, err := reader.ReadPacket()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		offsets = append(offsets, timestamp.Sub(start))
+	}
+	// Drone 1 is never in range, so only the direct link carries packets
+	expected := []time.Duration{5, 105, 205}
+	if len(offsets) != len(expected) {
+		t.Fatalf("expected deliveries at %v ms, got %v", expected, offsets)
+	}
+	for i := range expected {
+		if offsets[i] != expected[i]*time.Millisecond {
+			t.Fatalf("expected deliveries at %v ms, got %v", expected, offsets)
+		}
+	}
+}
+
+func TestOfflinePcapNeedsSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simulator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	inputPcap := filepath.Join(dir, "in.pcap")
+	writeInputPcap(t, inputPcap, time.Unix(1600000000, 0), 1)
+
+	offlineGeneral := general
+	offlineGeneral.Source = config.Endpoint{Type: "pcap", File: inputPcap}
+	source := newSource(config.Config{General: offlineGeneral})
+	defer source.Close()
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected a pcap source without a sink to be rejected")
+		}
+	}()
+	newSink(config.Config{General: offlineGeneral}, source)
+}
+
+func TestClassifierRules(t *testing.T) {
+	dscp := 0
+	rules := toFlowRules([]config.ClassifierRule{
+		{Protocol: "udp", SrcPort: 6000, SimulatedSrc: 2},
+		{SrcAddress: "100.64.0.4", Protocol: "udp", DstPort: 5001, DSCP: &dscp, SimulatedSrc: 1},
+	})
+	classifier := simulation.NewFlowClassifier(rules, 0)
+	if src := classifier.Classify(udpPacket(t, "data")); src != 1 {
+		t.Fatalf("packet classified as drone %d, expected 1", src)
+	}
+}
+
+func TestRateLinkWithoutDelay(t *testing.T) {
+	n := &network{}
+	linkConfig := n.toLinkConfig(map[string]interface{}{"type": "rate", "rate": 8000.}, 0, 1)
+	clock := simulation.NewVirtualClock(time.Unix(0, 0))
+	link := linkConfig.ToLinkEmulator(simulation.LinkEnvironment{Clock: clock, MaxQueueLength: 10})
+	link.SetOnIncomingPacket(func(simulation.Packet) {})
+	var arrival time.Duration
+	link.SetOnOutgoingPacket(func(simulation.Packet) { arrival = clock.Now().Sub(time.Unix(0, 0)) })
+	link.WriteIncomingPacket(&simulation.DataPacket{Data: make([]byte, 10)})
+	clock.RunUntilIdle()
+	// 10 bytes at 1000 bytes a second, and no time on the wire
+	if arrival != 10*time.Millisecond {
+		t.Fatalf("expected the packet after 10ms, got %v", arrival)
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	metricsGeneral := general
+	metricsGeneral.RoutingAlgorithm = config.RouterConfig{Type: "best_neighbor"}
+	simConfig := config.Config{
+		Topology: map[string]map[string]interface{}{
+			"0": {
+				"1":    map[string]interface{}{"type": "delay", "delay": 1.},
+				"base": map[string]interface{}{"type": "delay", "delay": 10.},
+			},
+			"1": {
+				"base": map[string]interface{}{"type": "delay", "delay": 2.},
+			},
+		},
+		General: metricsGeneral,
+	}
+	sink := simulation.NewChannelSink(10)
+	sim, _ := startSimulator(simConfig, simulation.NewVirtualClock(time.Unix(0, 0)), sink)
+	sim.WriteNewPacket(&simulation.DataPacket{Src: 0, HopsLeft: 2, Data: udpPacket(t, "data")}, 0)
+	sim.Stop(context.Background())
+	sink.Close()
+
+	server := httptest.NewServer(newMetricsHandler(sim))
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{
+		`simulator_link_packets_out_total{direction="forward",src="0",dst="999"} 1`,
+		`simulator_link_packets_out_total{direction="forward",src="1",dst="999"} 1`,
+		`simulator_link_queue_packets{direction="forward",src="0",dst="1"} 0`,
+		`simulator_router_picks_total{direction="forward",node="0",neighbor="1"} 1`,
+	} {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Fatalf("missing %q in:\n%s", line, body)
+		}
+	}
+}
+
+func TestControlAPI(t *testing.T) {
+	controlGeneral := general
+	controlGeneral.RoutingAlgorithm = config.RouterConfig{Type: "best_neighbor"}
+	simConfig := config.Config{
+		Topology: map[string]map[string]interface{}{
+			"0": {
+				"1":    map[string]interface{}{"type": "delay", "delay": 1.},
+				"base": map[string]interface{}{"type": "delay", "delay": 10.},
+			},
+			"1": {
+				"base": map[string]interface{}{"type": "delay", "delay": 2.},
+			},
+		},
+		General: controlGeneral,
+	}
+	epoch := time.Unix(0, 0)
+	clock := simulation.NewVirtualClock(epoch)
+	sink := simulation.NewChannelSink(10)
+	sim, n := startSimulator(simConfig, clock, sink)
+	c := &controller{config: simConfig, clock: clock, sim: sim, network: n, receiver: newReceiver(simConfig, clock, sim)}
+	server := httptest.NewServer(newControlHandler(c))
+	defer server.Close()
+
+	post := func(path string, body string, expected int) {
+		resp, err := http.Post(server.URL+path, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Fatalf("%s %s: expected status %d, got %d", path, body, expected, resp.StatusCode)
+		}
+	}
+	post("/links/down", `{"src": "0", "dst": "1"}`, http.StatusNoContent)
+	post("/links/replace", `{"src": "0", "dst": "base", "link": {"type": "delay", "delay": 20}}`, http.StatusNoContent)
+	post("/links/down", `{"src": "1", "dst": "0"}`, http.StatusNotFound)
+	post("/links/replace", `{"src": "0", "dst": "base", "link": {"type": "carrier pigeon"}}`, http.StatusBadRequest)
+	post("/router", `{"type": "broadcast"}`, http.StatusNoContent)
+	post("/maxHops", `{"maxHops": 3}`, http.StatusNoContent)
+	if c.receiver.maxHops != 3 {
+		t.Fatalf("max hops not changed: %d", c.receiver.maxHops)
+	}
+
+	c.receiver.receive(udpPacket(t, "data"))
+	sim.Stop(context.Background())
+	sink.Close()
+
+	// Only the replacement direct link carries the packet
+	var deliveries []time.Duration
+	for p := range sink.Packets() {
+		deliveries = append(deliveries, p.Time.Sub(epoch))
+	}
+	if len(deliveries) != 1 || deliveries[0] != 20*time.Millisecond {
+		t.Fatalf("unexpected deliveries %v", deliveries)
+	}
+}
+
+// Meant to be run with -race, as the neighbors change on the clock loop while
+// routers are replaced from the control API
+func TestReplaceRouterWhileTracking(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simulator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Drone 1 goes in and out of drone 0's range every 10ms for a minute
+	var waypoints strings.Builder
+	for offset := 0; offset <= 60000; offset += 10 {
+		x := 100
+		if offset%20 != 0 {
+			x = 2000
+		}
+		fmt.Fprintf(&waypoints, "%d %d 0\n", offset, x)
+	}
+	fixed := filepath.Join(dir, "fixed.txt")
+	moving := filepath.Join(dir, "moving.txt")
+	if err := ioutil.WriteFile(fixed, []byte("0 0 0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(moving, []byte(waypoints.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	controlGeneral := general
+	controlGeneral.RoutingAlgorithm = config.RouterConfig{Type: "best_neighbor"}
+	simConfig := config.Config{
+		Topology: map[string]map[string]interface{}{
+			"0": {
+				"1":    map[string]interface{}{"type": "mobile"},
+				"base": map[string]interface{}{"type": "delay", "delay": 10.},
+			},
+			"1": {
+				"base": map[string]interface{}{"type": "delay", "delay": 2.},
+			},
+		},
+		General: controlGeneral,
+		Mobility: &config.MobilityConfig{
+			Trajectories:   map[string]string{"0": fixed, "1": moving},
+			Model:          config.PropagationConfig{Range: 1000},
+			UpdateInterval: 1,
+		},
+	}
+	clock := simulation.NewVirtualClock(time.Unix(0, 0))
+	sink := simulation.NewChannelSink(10)
+	sim, n := startSimulator(simConfig, clock, sink)
+	c := &controller{config: simConfig, clock: clock, sim: sim, network: n, receiver: newReceiver(simConfig, clock, sim)}
+	server := httptest.NewServer(newControlHandler(c))
+	defer server.Close()
+
+	for i := 0; i < 20; i++ {
+		router := []string{"broadcast", "best_neighbor"}[i%2]
+		resp, err := http.Post(server.URL+"/router", "application/json", strings.NewReader(fmt.Sprintf(`{"type": %q}`, router)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("replacing the router with %s: expected status %d, got %d", router, http.StatusNoContent, resp.StatusCode)
+		}
+	}
+	sim.Stop(context.Background())
+	sink.Close()
+}
+
+func TestScheduledEvents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simulator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	start := time.Unix(1600000000, 0)
+	inputPcap := filepath.Join(dir, "in.pcap")
+	outputPcap := filepath.Join(dir, "out.pcap")
+	writeInputPcap(t, inputPcap, start, 3)
+
+	offlineGeneral := general
+	offlineGeneral.RoutingAlgorithm = config.RouterConfig{Type: "broadcast"}
+	offlineGeneral.Source = config.Endpoint{Type: "pcap", File: inputPcap}
+	offlineGeneral.Sink = config.Endpoint{Type: "pcap", File: outputPcap}
+	simConfig := config.Config{
+		Topology: map[string]map[string]interface{}{
+			"0": {
+				"1":    map[string]interface{}{"type": "delay", "delay": 1.},
+				"base": map[string]interface{}{"type": "delay", "delay": 5.},
+			},
+			"1": {
+				"base": map[string]interface{}{"type": "delay", "delay": 5.},
+			},
+		},
+		General: offlineGeneral,
+		Events: []config.Event{
+			{Time: 0.05, Action: "node_down", Node: "1"},
+			{Time: 0.15, Action: "replace_link", Src: "0", Dst: "base", Link: map[string]interface{}{"type": "delay", "delay": 20.}},
+		},
+	}
+	Start(simConfig, context.Background())
+
+	reader := simulation.NewPcapSource(outputPcap)
+	defer reader.Close()
+	var offsets []time.Duration
+	for {
+		_, timestamp, err := reader.ReadPacket()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		offsets = append(offsets, timestamp.Sub(start))
+	}
+
+	// Drone 1 leaves before the second packet, and the direct link slows
+	// down before the third
+	expected := []time.Duration{5, 6, 105, 220}
+	if len(offsets) != len(expected) {
+		t.Fatalf("expected deliveries at %v ms, got %v", expected, offsets)
+	}
+	for i := range expected {
+		if offsets[i] != expected[i]*time.Millisecond {
+			t.Fatalf("expected deliveries at %v ms, got %v", expected, offsets)
+		}
+	}
+}
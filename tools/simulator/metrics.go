@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+
+	. "github.com/aditiharini/simulator-proxy/simulation"
+	log "github.com/sirupsen/logrus"
+)
+
+// metricsHandler serves the simulator's counters at /metrics in the
+// Prometheus text format.
+type metricsHandler struct {
+	sim *BaseSimulator
+}
+
+func newMetricsHandler(sim *BaseSimulator) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler{sim: sim})
+	return mux
+}
+
+// Starts serving metrics on address in the background. The returned server is
+// shut down by stopServer.
+func serveMetrics(address string, sim *BaseSimulator) *http.Server {
+	server := serveHTTP(address, newMetricsHandler(sim))
+	log.WithFields(log.Fields{
+		"event":   "serve_metrics",
+		"address": address,
+	}).Info()
+	return server
+}
+
+func stopServer(server *http.Server) {
+	server.Shutdown(context.Background())
+}
+
+type metric struct {
+	name   string
+	kind   string
+	help   string
+	values []sample
+}
+
+type sample struct {
+	labels string
+	value  float64
+}
+
+func (m *metric) add(value float64, labels ...string) {
+	formatted := ""
+	for i := 0; i+1 < len(labels); i += 2 {
+		if formatted != "" {
+			formatted += ","
+		}
+		formatted += fmt.Sprintf("%s=%q", labels[i], labels[i+1])
+	}
+	m.values = append(m.values, sample{labels: formatted, value: value})
+}
+
+func (m *metric) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+	for _, s := range m.values {
+		if s.labels == "" {
+			fmt.Fprintf(w, "%s %g\n", m.name, s.value)
+		} else {
+			fmt.Fprintf(w, "%s{%s} %g\n", m.name, s.labels, s.value)
+		}
+	}
+}
+
+func sortedReasons(drops map[DropReason]int) []DropReason {
+	var reasons []DropReason
+	for reason := range drops {
+		reasons = append(reasons, reason)
+	}
+	sort.Slice(reasons, func(i, j int) bool { return reasons[i] < reasons[j] })
+	return reasons
+}
+
+func (h metricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	snapshot := h.sim.Snapshot()
+
+	queued := &metric{name: "simulator_link_queue_packets", kind: "gauge", help: "Packets waiting on or crossing the link."}
+	packetsIn := &metric{name: "simulator_link_packets_in_total", kind: "counter", help: "Packets accepted onto the link."}
+	packetsOut := &metric{name: "simulator_link_packets_out_total", kind: "counter", help: "Packets delivered by the link."}
+	bytesIn := &metric{name: "simulator_link_bytes_in_total", kind: "counter", help: "Bytes accepted onto the link."}
+	bytesOut := &metric{name: "simulator_link_bytes_out_total", kind: "counter", help: "Bytes delivered by the link."}
+	linkDrops := &metric{name: "simulator_link_drops_total", kind: "counter", help: "Packets dropped by the link, by reason."}
+	queueDelay := &metric{name: "simulator_link_queue_delay_seconds", kind: "gauge", help: "Mean time packets spent in the link's queue."}
+	traceOffset := &metric{name: "simulator_link_trace_offset_seconds", kind: "gauge", help: "Offset into the link's trace of the next delivery opportunity."}
+	routed := &metric{name: "simulator_router_routed_total", kind: "counter", help: "Packets the router was asked to route."}
+	copies := &metric{name: "simulator_router_copies_total", kind: "counter", help: "Copies the router put onto links."}
+	picks := &metric{name: "simulator_router_picks_total", kind: "counter", help: "Times the router picked neighbor as the best next hop from node."}
+	drops := &metric{name: "simulator_drops_total", kind: "counter", help: "Packets dropped anywhere in the simulation, by reason."}
+
+	directions := []struct {
+		name   string
+		links  []LinkStats
+		router RouterStats
+		drops  map[DropReason]int
+	}{
+		{"forward", snapshot.Links, snapshot.Router, snapshot.Drops},
+		{"return", snapshot.ReturnLinks, snapshot.ReturnRouter, snapshot.ReturnDrops},
+	}
+	for _, direction := range directions {
+		for _, link := range direction.links {
+			labels := []string{"direction", direction.name, "src", fmt.Sprint(link.Src), "dst", fmt.Sprint(link.Dst)}
+			queued.add(float64(link.Queued), labels...)
+			packetsIn.add(float64(link.Enqueued), labels...)
+			packetsOut.add(float64(link.Delivered), labels...)
+			bytesIn.add(float64(link.BytesIn), labels...)
+			bytesOut.add(float64(link.BytesOut), labels...)
+			queueDelay.add(link.QueueDelay.Seconds(), labels...)
+			traceOffset.add(link.TraceOffset.Seconds(), labels...)
+			for _, reason := range sortedReasons(link.Drops) {
+				linkDrops.add(float64(link.Drops[reason]), append(labels, "reason", string(reason))...)
+			}
+		}
+
+		routed.add(float64(direction.router.Routed), "direction", direction.name)
+		copies.add(float64(direction.router.Copies), "direction", direction.name)
+		var nodes []Address
+		for node := range direction.router.Picks {
+			nodes = append(nodes, node)
+		}
+		sort.Ints(nodes)
+		for _, node := range nodes {
+			var neighbors []Address
+			for neighbor := range direction.router.Picks[node] {
+				neighbors = append(neighbors, neighbor)
+			}
+			sort.Ints(neighbors)
+			for _, neighbor := range neighbors {
+				picks.add(float64(direction.router.Picks[node][neighbor]),
+					"direction", direction.name, "node", fmt.Sprint(node), "neighbor", fmt.Sprint(neighbor))
+			}
+		}
+
+		for _, reason := range sortedReasons(direction.drops) {
+			drops.add(float64(direction.drops[reason]), "direction", direction.name, "reason", string(reason))
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range []*metric{queued, packetsIn, packetsOut, bytesIn, bytesOut, linkDrops, queueDelay, traceOffset, routed, copies, picks, drops} {
+		m.write(w)
+	}
+}
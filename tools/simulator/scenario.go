@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	config "github.com/aditiharini/simulator-proxy/config/simulator"
+	. "github.com/aditiharini/simulator-proxy/simulation"
+)
+
+// Schedules every event in the configuration's events section, timed from
+// start. Events are checked against the links the simulator was set up with
+// up front, so a mistake in one is found when the run starts rather than when
+// the event comes up.
+func scheduleEvents(config config.Config, clock Clock, sim *BaseSimulator, n *network, r *receiver, start time.Time) {
+	simulatedDst := config.General.SimulatedDstAddress
+	links := make(map[Address]map[Address]bool)
+	for _, linkConfigs := range [][]LinkConfig{n.links, n.returnLinks} {
+		for _, linkConfig := range linkConfigs {
+			if links[linkConfig.SrcAddr()] == nil {
+				links[linkConfig.SrcAddr()] = make(map[Address]bool)
+			}
+			links[linkConfig.SrcAddr()][linkConfig.DstAddr()] = true
+		}
+	}
+
+	for _, event := range config.Events {
+		hasLink := func() (Address, Address) {
+			src, dst := toAddress(event.Src, simulatedDst), toAddress(event.Dst, simulatedDst)
+			if !links[src][dst] {
+				panic(fmt.Sprintf("event at %vs is for link %s->%s, which isn't in the topology", event.Time, event.Src, event.Dst))
+			}
+			return src, dst
+		}
+		hasNode := func() Address {
+			node := toAddress(event.Node, simulatedDst)
+			for src, dsts := range links {
+				if src == node || dsts[node] {
+					return node
+				}
+			}
+			panic(fmt.Sprintf("event at %vs is for node %s, which isn't in the topology", event.Time, event.Node))
+		}
+
+		var apply func(Controls) error
+		switch event.Action {
+		case "link_down":
+			src, dst := hasLink()
+			apply = func(c Controls) error { return c.TakeLinkDown(src, dst) }
+		case "link_up":
+			src, dst := hasLink()
+			apply = func(c Controls) error { return c.BringLinkUp(src, dst) }
+		case "node_down":
+			node := hasNode()
+			apply = func(c Controls) error { return c.TakeNodeDown(node) }
+		case "node_up":
+			node := hasNode()
+			apply = func(c Controls) error { return c.BringNodeUp(node) }
+		case "replace_link":
+			src, dst := hasLink()
+			linkConfig := n.toLinkConfig(event.Link, src, dst)
+			apply = func(c Controls) error { return c.ReplaceLink(linkConfig) }
+		case "max_hops":
+			maxHops := event.MaxHops
+			apply = func(c Controls) error {
+				r.setMaxHops(maxHops)
+				return nil
+			}
+		case "router":
+			if event.Router.Type != "broadcast" && event.Router.Type != "best_neighbor" {
+				panic(fmt.Sprintf("event at %vs switches to unsupported routing %q", event.Time, event.Router.Type))
+			}
+			routerConfig := config
+			routerConfig.General.RoutingAlgorithm = event.Router
+			apply = func(c Controls) error {
+				c.ReplaceRouter(newRouter(routerConfig, clock, n.neighbors))
+				return nil
+			}
+		default:
+			panic(fmt.Sprintf("unsupported event action %q", event.Action))
+		}
+
+		sim.Schedule(start.Add(time.Duration(event.Time*float64(time.Second))), func(c Controls) {
+			if err := apply(c); err != nil {
+				panic(err)
+			}
+		})
+	}
+}